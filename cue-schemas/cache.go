@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"dagger/cue-schemas/internal/dagger"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// returns a digest over the inputs of a source, including the content digests of what it fetches, and the tool versions
+func (m *CueSchemas) digest(inputs ...any) (string, error) {
+	b, err := json.Marshal(append([]any{m.TimoniVersion, m.CueVersion}, inputs...))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// returns a container with the module cache mounted at /cache
+func cacheContainer() *dagger.Container {
+	return dag.Container().
+		From("alpine").
+		WithMountedCache("/cache", dag.CacheVolume("cue-schemas-modules")).
+		// the cache volume is not part of the cache key, so lookups must not be cached
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+}
+
+// returns the cached directory for a digest, or nil if it wasn't produced before
+func cachedDirectory(ctx context.Context, digest string) (*dagger.Directory, error) {
+	ctr := cacheContainer().
+		WithExec([]string{"sh", "-c", fmt.Sprintf("if [ -d /cache/modules/%[1]s ]; then cp -r /cache/modules/%[1]s /out && echo hit; else mkdir /out; fi", digest)})
+	stdout, err := ctr.Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(stdout) != "hit" {
+		return nil, nil
+	}
+	return ctr.Directory("/out"), nil
+}
+
+// stores a directory in the cache under a digest
+func cacheDirectory(ctx context.Context, digest string, dir *dagger.Directory) error {
+	_, err := cacheContainer().
+		WithDirectory("/src", dir).
+		WithExec([]string{"sh", "-c", fmt.Sprintf("mkdir -p /cache/modules && rm -rf /cache/modules/%[1]s.tmp && cp -r /src /cache/modules/%[1]s.tmp && mv /cache/modules/%[1]s.tmp /cache/modules/%[1]s", digest)}).
+		Sync(ctx)
+	return err
+}
+
+// returns the content digests of the files to vendor, using the git blob SHA when it is known
+func (m *CueSchemas) fileDigests(ctx context.Context, files []githubFile) ([]string, error) {
+	var digests []string
+	for _, f := range files {
+		if f.SHA != "" {
+			digests = append(digests, f.SHA)
+			continue
+		}
+		digest, err := m.download(f.URL).Digest(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.URL, err)
+		}
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+// returns the digest of the Kubernetes schema artifact timoni vendors for a version
+func kubernetesSchemaDigest(ctx context.Context, version string) (string, error) {
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return "", err
+	}
+	stdout, err := craneContainer().
+		// the tag of a minor moves, so lookups must not be cached
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"crane", "digest", fmt.Sprintf("ghcr.io/stefanprodan/timoni/kubernetes-schema:v%d.%d", v.Major(), v.Minor())}).
+		Stdout(ctx)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
+// returns whether a module version is already in its registry
+func published(ctx context.Context, ctr *dagger.Container, registries []*Registry, path string, version string) (bool, error) {
+	r := registryFor(registries, path)
+	if r == nil {
+		return false, fmt.Errorf("no registry for module %s", path)
+	}
+	address, err := r.address(ctx)
+	if err != nil {
+		return false, err
+	}
+	args := []string{"crane", "digest", fmt.Sprintf("%s/%s:%s", address, path, version)}
+	if r.Insecure {
+		args = append(args, "--insecure")
+	}
+	// the registry is not part of the cache key, so lookups must not be cached
+	ctr = ctr.WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec(args, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+	code, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return false, err
+	}
+	if code == 0 {
+		return true, nil
+	}
+	stderr, err := ctr.Stderr(ctx)
+	if err != nil {
+		return false, err
+	}
+	if strings.Contains(stderr, "MANIFEST_UNKNOWN") || strings.Contains(stderr, "NAME_UNKNOWN") || strings.Contains(stderr, "404") {
+		return false, nil
+	}
+	return false, fmt.Errorf("%s:%s: %s", path, version, strings.TrimSpace(stderr))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"dagger/cue-schemas/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+type catalogEntry struct {
+	Module  string   `json:"module"`
+	Path    string   `json:"path"`
+	Major   string   `json:"major"`
+	Version string   `json:"version"`
+	Groups  []string `json:"apiGroups"`
+	Kinds   []string `json:"kinds"`
+	Source  string   `json:"source"`
+}
+
+var (
+	// CRD schemas generated by timoni
+	crdAPIVersionRegexp = regexp.MustCompile(`(?m)^\s*apiVersion: "([^"]+)"`)
+	crdKindRegexp       = regexp.MustCompile(`(?m)^\s*kind: "([^"]+)"`)
+	// Kubernetes API schemas generated by cue get go
+	k8sGroupRegexp = regexp.MustCompile(`(?m)^#GroupName: "([^"]*)"`)
+	k8sKindRegexp  = regexp.MustCompile(`(?m)^#(\w+): \{\n(?:\s*//.*\n)*\s*metav1\.#TypeMeta`)
+)
+
+// returns the API groups and kinds defined in a vendored module
+func (m *CueSchemas) apiResources(ctx context.Context, dir *dagger.Directory) ([]string, []string, error) {
+	contents, err := dag.Container().
+		From("alpine").
+		WithDirectory("/src", dir).
+		WithWorkdir("/src").
+		WithExec([]string{"sh", "-c", "find . -name '*.cue' -not -path './cue.mod/*' -exec cat {} +"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var groups, kinds []string
+	for _, match := range crdAPIVersionRegexp.FindAllStringSubmatch(contents, -1) {
+		if group, _, ok := strings.Cut(match[1], "/"); ok {
+			groups = append(groups, group)
+		}
+	}
+	for _, match := range k8sGroupRegexp.FindAllStringSubmatch(contents, -1) {
+		if match[1] == "" {
+			groups = append(groups, "core")
+		} else {
+			groups = append(groups, match[1])
+		}
+	}
+	for _, match := range crdKindRegexp.FindAllStringSubmatch(contents, -1) {
+		kinds = append(kinds, match[1])
+	}
+	for _, match := range k8sKindRegexp.FindAllStringSubmatch(contents, -1) {
+		kinds = append(kinds, match[1])
+	}
+	slices.Sort(groups)
+	slices.Sort(kinds)
+	return slices.Compact(groups), slices.Compact(kinds), nil
+}
+
+func (m *CueSchemas) catalogEntry(ctx context.Context, dir *dagger.Directory, path string, version string, source string) (catalogEntry, error) {
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return catalogEntry{}, err
+	}
+	groups, kinds, err := m.apiResources(ctx, dir)
+	if err != nil {
+		return catalogEntry{}, err
+	}
+	return catalogEntry{
+		Module:  fmt.Sprintf("%s@v%d", path, v.Major()),
+		Path:    path,
+		Major:   fmt.Sprintf("v%d", v.Major()),
+		Version: version,
+		Groups:  groups,
+		Kinds:   kinds,
+		Source:  source,
+	}, nil
+}
+
+// generate a JSON and Markdown catalog of the modules in a sources file
+func (m *CueSchemas) Catalog(ctx context.Context, file *dagger.File) (*dagger.Directory, error) {
+	_, sources, err := m.sources(ctx, file, false)
+	if err != nil {
+		return nil, err
+	}
+	var catalog []catalogEntry
+	for _, s := range sources.Github {
+		mods, err := m.VendorGithub(ctx, s.Tag, s.Ref, s.Owner, s.Repo, s.Files, s.Dirs, s.Assets, s.Kubernetes)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := mods.Entries(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ref := s.Ref
+		if ref == "" {
+			ref = s.Tag
+		}
+		for _, e := range entries {
+			e = strings.TrimSuffix(e, "/")
+			entry, err := m.catalogEntry(ctx, mods.Directory(e), strings.TrimSuffix(e, "-"+s.Tag), s.Tag,
+				fmt.Sprintf("https://github.com/%s/%s/tree/%s", s.Owner, s.Repo, ref))
+			if err != nil {
+				return nil, err
+			}
+			catalog = append(catalog, entry)
+		}
+	}
+	for _, s := range sources.Kubernetes {
+		mods, err := m.VendorKubernetes(s.Version, s.Include, s.Exclude)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := m.catalogEntry(ctx, mods.Directory("k8s.io-"+s.Version), "k8s.io", s.Version,
+			fmt.Sprintf("https://github.com/kubernetes/kubernetes/tree/%s", s.Version))
+		if err != nil {
+			return nil, err
+		}
+		catalog = append(catalog, entry)
+	}
+	for _, s := range sources.Openapi {
+		mods, err := m.VendorOpenapi(s.Module, s.Version, s.URL)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := m.catalogEntry(ctx, mods.Directory(moduleDir(s.Module, s.Version)), s.Module, s.Version, s.URL)
+		if err != nil {
+			return nil, err
+		}
+		catalog = append(catalog, entry)
+	}
+	for _, s := range sources.timoni(m.TimoniVersion) {
+		mods, err := m.VendorTimoni(s.Version)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := m.catalogEntry(ctx, mods.Directory("timoni.sh-"+s.Version), "timoni.sh", s.Version,
+			fmt.Sprintf("https://github.com/stefanprodan/timoni/tree/%s", s.Version))
+		if err != nil {
+			return nil, err
+		}
+		catalog = append(catalog, entry)
+	}
+	slices.SortFunc(catalog, func(a, b catalogEntry) int {
+		if c := strings.Compare(a.Path, b.Path); c != 0 {
+			return c
+		}
+		return semver.MustParse(a.Version).Compare(semver.MustParse(b.Version))
+	})
+	index, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	md := "# CUE schemas\n\n| Module | Version | API groups | Kinds | Source |\n| --- | --- | --- | --- | --- |\n"
+	for _, e := range catalog {
+		md += fmt.Sprintf("| `%s` | %s | %s | %s | [%s](%s) |\n",
+			e.Module, e.Version, strings.Join(e.Groups, ", "), strings.Join(e.Kinds, ", "),
+			strings.TrimPrefix(e.Source, "https://github.com/"), e.Source)
+	}
+	return dag.Directory().
+		WithNewFile("catalog.json", string(index)+"\n").
+		WithNewFile("catalog.md", md), nil
+}
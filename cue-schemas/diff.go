@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"dagger/cue-schemas/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/format"
+	"cuelang.org/go/cue/parser"
+	"cuelang.org/go/cue/token"
+	"github.com/Masterminds/semver/v3"
+)
+
+// a change to a field of a definition
+type fieldChange struct {
+	Path   string `json:"path"`
+	Change string `json:"change"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// the changes to a module between two sources files
+type moduleDiff struct {
+	Path       string        `json:"path"`
+	Change     string        `json:"change"`
+	OldVersion string        `json:"oldVersion,omitempty"`
+	NewVersion string        `json:"newVersion,omitempty"`
+	Fields     []fieldChange `json:"fields,omitempty"`
+}
+
+// formats an expression on a single line without comments
+func exprString(expr ast.Expr) string {
+	ast.Walk(expr, func(n ast.Node) bool {
+		ast.SetComments(n, nil)
+		return true
+	}, nil)
+	b, err := format.Node(expr)
+	if err != nil {
+		return fmt.Sprintf("%T", expr)
+	}
+	return strings.Join(strings.Fields(string(b)), " ")
+}
+
+// records the type of every field below a definition, recursing into structs and lists of structs
+func collectFields(fields map[string]string, prefix string, expr ast.Expr) {
+	switch x := expr.(type) {
+	case *ast.StructLit:
+		for _, decl := range x.Elts {
+			switch d := decl.(type) {
+			case *ast.Field:
+				name, _, err := ast.LabelName(d.Label)
+				if err != nil {
+					continue
+				}
+				p := prefix + "." + name
+				switch d.Constraint {
+				case token.OPTION:
+					fields[p] = "optional "
+				case token.NOT:
+					fields[p] = "required "
+				default:
+					fields[p] = ""
+				}
+				fields[p] += typeString(d.Value)
+				collectFields(fields, p, d.Value)
+			case *ast.EmbedDecl:
+				collectFields(fields, prefix, d.Expr)
+			}
+		}
+	case *ast.BinaryExpr:
+		if x.Op == token.AND {
+			collectFields(fields, prefix, x.X)
+			collectFields(fields, prefix, x.Y)
+		}
+	case *ast.ListLit:
+		for _, e := range x.Elts {
+			if e, ok := e.(*ast.Ellipsis); ok && e.Type != nil {
+				collectFields(fields, prefix+"[]", e.Type)
+			}
+		}
+	}
+}
+
+// describes the type of a field value, structs are described by their fields
+func typeString(expr ast.Expr) string {
+	switch x := expr.(type) {
+	case *ast.StructLit:
+		return "struct"
+	case *ast.BinaryExpr:
+		if x.Op == token.AND {
+			var parts []string
+			for _, e := range []ast.Expr{x.X, x.Y} {
+				if s := typeString(e); s != "struct" {
+					parts = append(parts, s)
+				}
+			}
+			if len(parts) == 0 {
+				return "struct"
+			}
+			return strings.Join(parts, " & ")
+		}
+	case *ast.ListLit:
+		if len(x.Elts) == 1 {
+			if e, ok := x.Elts[0].(*ast.Ellipsis); ok && e.Type != nil {
+				return "[..." + typeString(e.Type) + "]"
+			}
+		}
+	}
+	return exprString(expr)
+}
+
+// returns the fields of the definitions in a vendored module, keyed by package and path
+func (m *CueSchemas) definitionFields(ctx context.Context, dir *dagger.Directory) (map[string]string, error) {
+	files, err := dir.Glob(ctx, "**/*.cue")
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]string{}
+	for _, name := range files {
+		if strings.HasPrefix(name, "cue.mod/") {
+			continue
+		}
+		contents, err := dir.File(name).Contents(ctx)
+		if err != nil {
+			return nil, err
+		}
+		f, err := parser.ParseFile(name, contents)
+		if err != nil {
+			return nil, err
+		}
+		pkg := path.Dir(name)
+		for _, decl := range f.Decls {
+			field, ok := decl.(*ast.Field)
+			if !ok {
+				continue
+			}
+			label, _, err := ast.LabelName(field.Label)
+			if err != nil || !strings.HasPrefix(label, "#") {
+				continue
+			}
+			collectFields(fields, pkg+":"+label, field.Value)
+		}
+	}
+	return fields, nil
+}
+
+// compares the fields of two module versions
+func diffFields(before map[string]string, after map[string]string) []fieldChange {
+	var changes []fieldChange
+	for p, o := range before {
+		if n, ok := after[p]; !ok {
+			changes = append(changes, fieldChange{Path: p, Change: "removed", Old: o})
+		} else if n != o {
+			changes = append(changes, fieldChange{Path: p, Change: "changed", Old: o, New: n})
+		}
+	}
+	for p, n := range after {
+		if _, ok := before[p]; !ok {
+			changes = append(changes, fieldChange{Path: p, Change: "added", New: n})
+		}
+	}
+	slices.SortFunc(changes, func(a, b fieldChange) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return changes
+}
+
+// vendors a sources file and returns its modules grouped by path
+func (m *CueSchemas) vendoredModules(ctx context.Context, file *dagger.File) (*dagger.Directory, map[string][]vendoredModule, error) {
+	_, sources, err := m.sources(ctx, file, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, mods, _, err := m.vendor(ctx, sources, false, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	byPath := map[string][]vendoredModule{}
+	for _, mod := range mods {
+		byPath[mod.Path] = append(byPath[mod.Path], mod)
+	}
+	return dir, byPath, nil
+}
+
+// returns the minor of a version, or the version itself if it isn't semver
+func versionMinor(version string) string {
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return version
+	}
+	return fmt.Sprintf("v%d.%d", v.Major(), v.Minor())
+}
+
+// pairs the versions of a module in two sources files: identical versions first, then versions of the same minor,
+// then the remaining versions in ascending order, the unpaired versions are returned as removed and added
+func pairVersions(before []vendoredModule, after []vendoredModule) ([][2]vendoredModule, []vendoredModule, []vendoredModule) {
+	compare := func(a, b vendoredModule) int {
+		va, errA := semver.NewVersion(a.Version)
+		vb, errB := semver.NewVersion(b.Version)
+		if errA != nil || errB != nil {
+			return strings.Compare(a.Version, b.Version)
+		}
+		return va.Compare(vb)
+	}
+	before, after = slices.Clone(before), slices.Clone(after)
+	slices.SortFunc(before, compare)
+	slices.SortFunc(after, compare)
+	var pairs [][2]vendoredModule
+	for _, match := range []func(a, b vendoredModule) bool{
+		func(a, b vendoredModule) bool { return a.Version == b.Version },
+		func(a, b vendoredModule) bool { return versionMinor(a.Version) == versionMinor(b.Version) },
+		func(a, b vendoredModule) bool { return true },
+	} {
+		for i := 0; i < len(before); i++ {
+			j := slices.IndexFunc(after, func(b vendoredModule) bool { return match(before[i], b) })
+			if j < 0 {
+				continue
+			}
+			pairs = append(pairs, [2]vendoredModule{before[i], after[j]})
+			before = slices.Delete(before, i, i+1)
+			after = slices.Delete(after, j, j+1)
+			i--
+		}
+	}
+	return pairs, before, after
+}
+
+// generate a Markdown and JSON report of the schema changes between two sources files
+func (m *CueSchemas) Diff(
+	ctx context.Context,
+	// the sources file before the change
+	before *dagger.File,
+	// the sources file after the change
+	after *dagger.File,
+) (*dagger.Directory, error) {
+	beforeDir, beforeMods, err := m.vendoredModules(ctx, before)
+	if err != nil {
+		return nil, fmt.Errorf("before: %w", err)
+	}
+	afterDir, afterMods, err := m.vendoredModules(ctx, after)
+	if err != nil {
+		return nil, fmt.Errorf("after: %w", err)
+	}
+	paths := slices.Collect(maps.Keys(beforeMods))
+	for p := range afterMods {
+		if _, ok := beforeMods[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	slices.Sort(paths)
+	var diffs []moduleDiff
+	for _, p := range paths {
+		pairs, removed, added := pairVersions(beforeMods[p], afterMods[p])
+		for _, pair := range pairs {
+			o, n := pair[0], pair[1]
+			if o.Digest == n.Digest {
+				continue
+			}
+			oldFields, err := m.definitionFields(ctx, beforeDir.Directory(o.Dir))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", o.Source, err)
+			}
+			newFields, err := m.definitionFields(ctx, afterDir.Directory(n.Dir))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", n.Source, err)
+			}
+			fields := diffFields(oldFields, newFields)
+			if len(fields) == 0 && o.Version == n.Version {
+				continue
+			}
+			diffs = append(diffs, moduleDiff{Path: p, Change: "changed", OldVersion: o.Version, NewVersion: n.Version, Fields: fields})
+		}
+		for _, o := range removed {
+			diffs = append(diffs, moduleDiff{Path: p, Change: "removed", OldVersion: o.Version})
+		}
+		for _, n := range added {
+			diffs = append(diffs, moduleDiff{Path: p, Change: "added", NewVersion: n.Version})
+		}
+	}
+	report, err := json.MarshalIndent(diffs, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	md := "# CUE schema changes\n\n"
+	if len(diffs) == 0 {
+		md += "No changes.\n"
+	}
+	for _, d := range diffs {
+		switch d.Change {
+		case "added":
+			md += fmt.Sprintf("## `%s` added\n\nVersion %s.\n\n", d.Path, d.NewVersion)
+		case "removed":
+			md += fmt.Sprintf("## `%s` removed\n\nVersion %s.\n\n", d.Path, d.OldVersion)
+		default:
+			md += fmt.Sprintf("## `%s` %s → %s\n\n", d.Path, d.OldVersion, d.NewVersion)
+			if len(d.Fields) == 0 {
+				md += "No field changes.\n\n"
+				continue
+			}
+			md += "| Field | Change | Old | New |\n| --- | --- | --- | --- |\n"
+			for _, f := range d.Fields {
+				md += fmt.Sprintf("| `%s` | %s | %s | %s |\n", f.Path, f.Change, markdownCode(f.Old), markdownCode(f.New))
+			}
+			md += "\n"
+		}
+	}
+	return dag.Directory().
+		WithNewFile("diff.json", string(report)+"\n").
+		WithNewFile("diff.md", md), nil
+}
+
+// formats a value as inline code in a Markdown table cell
+func markdownCode(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "`" + strings.ReplaceAll(s, "|", `\|`) + "`"
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+)
+
+// removes the API packages of the k8s.io module that aren't selected by $INCLUDE and $EXCLUDE,
+// keeping the packages imported by the selected ones
+const trimKubernetesScript = `set -eu
+matches() {
+	for f in $2; do
+		case "$1" in "$f" | "$f"/*) return 0 ;; esac
+	done
+	return 1
+}
+keep=""
+for d in api/*/*; do
+	p=${d#api/}
+	if { [ -z "$INCLUDE" ] || matches "$p" "$INCLUDE"; } && ! matches "$p" "$EXCLUDE"; then
+		keep="$keep $d"
+	fi
+done
+while :; do
+	new=$keep
+	for d in $(for k in $keep; do grep -ho '"k8s.io/api/[^"]*"' $k/*.cue || true; done | tr -d '"' | sed 's|^k8s.io/||' | sort -u); do
+		case " $new " in *" $d "*) ;; *) new="$new $d" ;; esac
+	done
+	[ "$new" = "$keep" ] && break
+	keep=$new
+done
+for d in api/*/*; do
+	case " $keep " in *" $d "*) ;; *) rm -rf "$d" ;; esac
+done
+find api -type d -empty -delete
+`
+
+// converts API group filters (e.g. core/v1, networking.k8s.io) to k8s.io/api package paths (e.g. core/v1, networking)
+func kubernetesPackages(groups []string) string {
+	var pkgs []string
+	for _, g := range groups {
+		group, version, _ := strings.Cut(g, "/")
+		pkg, _, _ := strings.Cut(group, ".")
+		if version != "" {
+			pkg += "/" + version
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return strings.Join(pkgs, " ")
+}
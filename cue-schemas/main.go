@@ -3,18 +3,22 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"dagger/cue-schemas/internal/dagger"
 	_ "embed"
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"path"
+	"slices"
 	"strings"
 
 	"cuelang.org/go/cue"
-	"cuelang.org/go/cue/cuecontext"
+	cuejson "cuelang.org/go/encoding/json"
 	"cuelang.org/go/encoding/yaml"
 	"github.com/Masterminds/semver/v3"
 	"github.com/google/go-github/v67/github"
-	yamlv3 "gopkg.in/yaml.v3"
 )
 
 type CueSchemas struct {
@@ -22,25 +26,58 @@ type CueSchemas struct {
 	TimoniVersion string
 	// returns the cue version
 	CueVersion string
+	// returns the GitHub API URL
+	GithubAPI string
+	// returns the URL raw GitHub files are downloaded from
+	GithubRaw string
+	// returns the URL GitHub release assets are downloaded from
+	GithubDownload string
+	// +private
+	GithubService *dagger.Service
+	// +private
+	Registries []*Registry
 }
 
 type GithubSource struct {
-	Tag    string   `yaml:"tag"`
-	Ref    string   `yaml:"ref"`
-	Owner  string   `yaml:"owner"`
-	Repo   string   `yaml:"repo"`
-	Files  []string `yaml:"files"`
-	Dirs   []string `yaml:"dirs"`
-	Assets []string `yaml:"assets"`
+	Tag        string   `json:"tag"`
+	Ref        string   `json:"ref"`
+	Owner      string   `json:"owner"`
+	Repo       string   `json:"repo"`
+	Files      []string `json:"files"`
+	Dirs       []string `json:"dirs"`
+	Assets     []string `json:"assets"`
+	Kubernetes string   `json:"kubernetes"`
 }
 
 type KubernetesSource struct {
-	Version string `yaml:"version"`
+	Version string   `json:"version"`
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+type TimoniSource struct {
+	Version string `json:"version"`
+}
+
+type OpenapiSource struct {
+	Module  string `json:"module"`
+	Version string `json:"version"`
+	URL     string `json:"url"`
 }
 
 type Sources struct {
-	Github     []GithubSource     `yaml:"github"`
-	Kubernetes []KubernetesSource `yaml:"kubernetes"`
+	Github     []GithubSource     `json:"github"`
+	Kubernetes []KubernetesSource `json:"kubernetes"`
+	Timoni     []TimoniSource     `json:"timoni"`
+	Openapi    []OpenapiSource    `json:"openapi"`
+}
+
+// returns the timoni versions to vendor, defaulting to the given version
+func (s *Sources) timoni(version string) []TimoniSource {
+	if len(s.Timoni) == 0 {
+		return []TimoniSource{{Version: version}}
+	}
+	return s.Timoni
 }
 
 //go:embed schema.cue
@@ -55,46 +92,96 @@ func New(
 	// +default="v0.11.0"
 	// the desired CUE version
 	cueVersion string,
+	// +optional
+	// +default="https://api.github.com"
+	// the GitHub API URL
+	githubApi string,
+	// +optional
+	// +default="https://raw.githubusercontent.com"
+	// the URL raw GitHub files are downloaded from
+	githubRaw string,
+	// +optional
+	// +default="https://github.com"
+	// the URL GitHub release assets are downloaded from
+	githubDownload string,
+	// +optional
+	// the service the GitHub URLs point to, e.g. a GitHub mirror running in the pipeline
+	githubService *dagger.Service,
 ) *CueSchemas {
 	return &CueSchemas{
-		TimoniVersion: timoniVersion,
-		CueVersion:    cueVersion,
+		TimoniVersion:  timoniVersion,
+		CueVersion:     cueVersion,
+		GithubAPI:      githubApi,
+		GithubRaw:      githubRaw,
+		GithubDownload: githubDownload,
+		GithubService:  githubService,
 	}
 }
 
 // returns a container with the timoni and cue binaries
 func (m *CueSchemas) Container() *dagger.Container {
+	return m.container(m.TimoniVersion)
+}
+
+func (m *CueSchemas) container(timoniVersion string) *dagger.Container {
 	return dag.Container().
 		From("golang").
-		WithExec([]string{"go", "install", fmt.Sprintf("github.com/stefanprodan/timoni/cmd/timoni@%s", m.TimoniVersion)}).
+		WithExec([]string{"go", "install", fmt.Sprintf("github.com/stefanprodan/timoni/cmd/timoni@%s", timoniVersion)}).
 		WithExec([]string{"go", "install", fmt.Sprintf("cuelang.org/go/cmd/cue@%s", m.CueVersion)})
 }
 
 // vendor Kubernetes API CUE schemas
-func (m *CueSchemas) VendorKubernetes(version string) *dagger.Directory {
-	semver := semver.MustParse(version)
-	dir := m.Container().
+func (m *CueSchemas) VendorKubernetes(
+	version string,
+	// +optional
+	// the API groups to vendor (e.g. core/v1, apps/v1, networking.k8s.io), all if empty
+	include []string,
+	// +optional
+	// the API groups to leave out
+	exclude []string,
+) (*dagger.Directory, error) {
+	semver, err := semver.NewVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	ctr := m.Container().
 		WithExec([]string{"cue", "mod", "init"}).
 		WithExec([]string{"timoni", "mod", "vendor", "k8s", "-v", fmt.Sprintf("%d.%d", semver.Major(), semver.Minor())}).
-		WithWorkdir("cue.mod/gen/k8s.io").
+		WithWorkdir("cue.mod/gen/k8s.io")
+	if len(include) > 0 || len(exclude) > 0 {
+		ctr = ctr.WithEnvVariable("INCLUDE", kubernetesPackages(include)).
+			WithEnvVariable("EXCLUDE", kubernetesPackages(exclude)).
+			WithExec([]string{"sh", "-c", trimKubernetesScript})
+	}
+	dir := ctr.
 		WithExec([]string{"cue", "mod", "init", fmt.Sprintf("k8s.io@v%d", semver.Major()), "--source=self"}).
 		Directory(".")
 	return dag.Container().
 		WithDirectory(fmt.Sprintf("k8s.io-%s", version), dir).
-		Directory(".")
+		Directory("."), nil
 }
 
-// vendor Timoni CUE schemas for the current version
-func (m *CueSchemas) VendorTimoni() *dagger.Directory {
-	semver := semver.MustParse(m.TimoniVersion)
-	dir := m.Container().
+// vendor Timoni CUE schemas with the given timoni version
+func (m *CueSchemas) VendorTimoni(
+	// +optional
+	// the timoni version, defaults to the current version
+	version string,
+) (*dagger.Directory, error) {
+	if version == "" {
+		version = m.TimoniVersion
+	}
+	semver, err := semver.NewVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	dir := m.container(version).
 		WithExec([]string{"timoni", "mod", "init", "derp"}).
 		WithWorkdir("derp/cue.mod/pkg/timoni.sh").
 		WithExec([]string{"cue", "mod", "init", fmt.Sprintf("timoni.sh@v%d", semver.Major()), "--source=self"}).
 		Directory(".")
 	return dag.Container().
-		WithDirectory(fmt.Sprintf("timoni.sh-%s", m.TimoniVersion), dir).
-		Directory(".")
+		WithDirectory(fmt.Sprintf("timoni.sh-%s", version), dir).
+		Directory("."), nil
 }
 
 // vendor Kubernetes CRD CUE schemas from GitHub
@@ -117,85 +204,394 @@ func (m *CueSchemas) VendorGithub(
 	// +optional
 	// the repo release assets to vendor
 	asset []string,
+	// +optional
+	// the k8s.io module version to import ObjectMeta from instead of inlining it
+	kubernetesVersion string,
 ) (*dagger.Directory, error) {
-	semver := semver.MustParse(tag)
+	files, err := m.githubFiles(ctx, tag, ref, owner, repo, file, dir, asset)
+	if err != nil {
+		return nil, err
+	}
+	return m.vendorCRDs(ctx, tag, files, kubernetesVersion)
+}
+
+// a file to vendor and its git blob SHA if known
+type githubFile struct {
+	URL string
+	SHA string
+}
+
+// resolves the URLs of the files, directory entries and release assets to vendor
+func (m *CueSchemas) githubFiles(ctx context.Context, tag string, ref string, owner string, repo string, file []string, dir []string, asset []string) ([]githubFile, error) {
 	client := github.NewClient(nil)
+	if m.GithubAPI != "" {
+		baseURL, err := url.Parse(strings.TrimSuffix(m.GithubAPI, "/") + "/")
+		if err != nil {
+			return nil, err
+		}
+		client.BaseURL = baseURL
+	}
+	raw := strings.TrimSuffix(cmp.Or(m.GithubRaw, "https://raw.githubusercontent.com"), "/")
+	download := strings.TrimSuffix(cmp.Or(m.GithubDownload, "https://github.com"), "/")
 	if ref == "" {
 		ref = tag
 	}
-	var files []string
+	var files []githubFile
 	for _, f := range file {
-		files = append(files, fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/refs/tags/%s/%s", owner, repo, ref, f))
+		files = append(files, githubFile{URL: fmt.Sprintf("%s/%s/%s/refs/tags/%s/%s", raw, owner, repo, ref, f)})
 	}
 	for _, d := range dir {
-		_, entries, _, err := client.Repositories.GetContents(ctx, owner, repo, d, &github.RepositoryContentGetOptions{Ref: ref})
+		entries, err := m.githubContents(ctx, client, owner, repo, d, ref)
 		if err != nil {
 			return nil, err
 		}
 		for _, e := range entries {
 			if strings.HasSuffix(e.GetName(), ".yml") || strings.HasSuffix(e.GetName(), ".yaml") {
-				files = append(files, e.GetDownloadURL())
+				files = append(files, githubFile{URL: e.GetDownloadURL(), SHA: e.GetSHA()})
 			}
 		}
 	}
 	for _, a := range asset {
-		files = append(files, fmt.Sprintf("https://github.com/%s/%s/releases/download/%s/%s", owner, repo, ref, a))
+		files = append(files, githubFile{URL: fmt.Sprintf("%s/%s/%s/releases/download/%s/%s", download, owner, repo, ref, a)})
 	}
-	ctr := m.Container().
-		WithExec([]string{"cue", "mod", "init"})
-	for _, f := range files {
-		ctr = ctr.WithExec([]string{"timoni", "mod", "vendor", "crds", "-f", f})
+	return files, nil
+}
+
+// lists a repository directory with the contents API, reaching it through the GitHub service if set
+func (m *CueSchemas) githubContents(ctx context.Context, client *github.Client, owner string, repo string, dir string, ref string) ([]*github.RepositoryContent, error) {
+	if m.GithubService == nil {
+		_, entries, _, err := client.Repositories.GetContents(ctx, owner, repo, dir, &github.RepositoryContentGetOptions{Ref: ref})
+		return entries, err
+	}
+	// the service is bound to the engine's HTTP fetches, not to this function
+	u := fmt.Sprintf("%srepos/%s/%s/contents/%s?ref=%s", client.BaseURL, owner, repo, dir, url.QueryEscape(ref))
+	body, err := m.download(u).Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*github.RepositoryContent
+	if err := json.Unmarshal([]byte(body), &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
+	return entries, nil
+}
+
+// returns a file downloaded from a URL, reaching it through the GitHub service if set
+func (m *CueSchemas) download(url string) *dagger.File {
+	if m.GithubService != nil {
+		return dag.HTTP(url, dagger.HTTPOpts{ExperimentalServiceHost: m.GithubService})
+	}
+	return dag.HTTP(url)
+}
+
+// vendors the CRDs in the files into one module per API group
+func (m *CueSchemas) vendorCRDs(ctx context.Context, tag string, files []githubFile, kubernetesVersion string) (*dagger.Directory, error) {
+	semver, err := semver.NewVersion(tag)
+	if err != nil {
+		return nil, err
+	}
+	ctr, paths, err := m.withCRDs(ctx, m.Container().WithExec([]string{"cue", "mod", "init"}), files)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		ctr = ctr.WithExec([]string{"timoni", "mod", "vendor", "crds", "-f", p})
 	}
 	ctr = ctr.WithWorkdir("cue.mod/gen")
-	mods, _ := ctr.Directory(".").Entries(ctx)
+	mods, err := ctr.Directory(".").Entries(ctx)
+	if err != nil {
+		return nil, err
+	}
 	for _, mod := range mods {
 		ctr = ctr.WithWorkdir(mod).
 			WithExec([]string{"cue", "mod", "init", fmt.Sprintf("%s@v%d", mod, semver.Major()), "--source=self"}).
 			WithWorkdir("..")
+		if kubernetesVersion != "" {
+			if ctr, err = withObjectMetaImport(ctx, ctr, mod, kubernetesVersion); err != nil {
+				return nil, err
+			}
+		}
 		ctr = ctr.WithDirectory(fmt.Sprintf("%s-%s", mod, tag), ctr.Directory(mod)).
 			WithoutDirectory(mod)
 	}
 	return ctr.Directory("."), nil
 }
 
-// validate a sources.yaml file
-func (m *CueSchemas) Validate(ctx context.Context, file *dagger.File) error {
-	cctx := cuecontext.New()
-	schema := cctx.CompileString(schemaFile).LookupPath(cue.ParsePath("#Schema"))
-	contents, _ := file.Contents(ctx)
-	return yaml.Validate([]byte(contents), schema)
+// compiles a sources file (sources.yaml, sources.json or sources.cue)
+func (m *CueSchemas) compileSources(ctx context.Context, cctx *cue.Context, file *dagger.File) (cue.Value, error) {
+	name, err := file.Name(ctx)
+	if err != nil {
+		return cue.Value{}, err
+	}
+	contents, err := file.Contents(ctx)
+	if err != nil {
+		return cue.Value{}, err
+	}
+	var value cue.Value
+	switch path.Ext(name) {
+	case ".cue":
+		value = cctx.CompileString(contents, cue.Filename(name))
+	case ".json":
+		expr, err := cuejson.Extract(name, []byte(contents))
+		if err != nil {
+			return cue.Value{}, err
+		}
+		value = cctx.BuildExpr(expr)
+	default:
+		f, err := yaml.Extract(name, []byte(contents))
+		if err != nil {
+			return cue.Value{}, err
+		}
+		value = cctx.BuildFile(f)
+	}
+	return value, value.Err()
 }
 
-// vendor CUE schemas from a sources.yaml file
-func (m *CueSchemas) Vendor(ctx context.Context, file *dagger.File) (*dagger.Directory, error) {
-	if err := m.Validate(ctx, file); err != nil {
-		return nil, err
+// returns the diagnostics for a sources file (sources.yaml, sources.json or sources.cue)
+func (m *CueSchemas) Diagnostics(
+	ctx context.Context,
+	file *dagger.File,
+	// +optional
+	// warn about unknown keys instead of rejecting them
+	allowUnknown bool,
+) ([]*Diagnostic, error) {
+	diags, _, err := m.diagnose(ctx, file, allowUnknown)
+	return diags, err
+}
+
+// validate a sources file (sources.yaml, sources.json or sources.cue)
+func (m *CueSchemas) Validate(
+	ctx context.Context,
+	file *dagger.File,
+	// +optional
+	// warn about unknown keys instead of rejecting them
+	allowUnknown bool,
+) error {
+	_, _, err := m.sources(ctx, file, allowUnknown)
+	return err
+}
+
+// validates and decodes a sources file
+func (m *CueSchemas) sources(ctx context.Context, file *dagger.File, allowUnknown bool) ([]*Diagnostic, *Sources, error) {
+	diags, sources, err := m.diagnose(ctx, file, allowUnknown)
+	if err != nil {
+		return nil, nil, err
 	}
-	contents, _ := file.Contents(ctx)
-	var sources Sources
-	if err := yamlv3.Unmarshal([]byte(contents), &sources); err != nil {
-		return nil, err
+	if sources == nil {
+		var msgs []string
+		for _, d := range diags {
+			if d.Severity == "error" {
+				msgs = append(msgs, d.String())
+			}
+		}
+		return diags, nil, fmt.Errorf("invalid sources:\n%s", strings.Join(msgs, "\n"))
 	}
+	return diags, sources, nil
+}
+
+// a module directory and the source it was vendored from
+type vendoredModule struct {
+	Dir     string
+	Path    string
+	Version string
+	Source  string
+	Digest  string
+}
+
+// a source that failed to vendor or publish
+type Failure struct {
+	// the source, e.g. github[0] fluxcd/flux2@v2.4.0
+	Source string
+	// the error message
+	Error string
+}
+
+// vendors the sources into a single directory, recording failures instead of aborting when continueOnError is set
+// and reusing previously generated modules with the same digest when incremental is set
+func (m *CueSchemas) vendor(ctx context.Context, sources *Sources, continueOnError bool, incremental bool) (*dagger.Directory, []vendoredModule, []*Failure, error) {
 	ctr := dag.Container()
-	for _, s := range sources.Github {
-		mods, err := m.VendorGithub(ctx, s.Tag, s.Ref, s.Owner, s.Repo, s.Files, s.Dirs, s.Assets)
+	var mods []vendoredModule
+	var failures []*Failure
+	produced := map[string]string{}
+	fail := func(source string, err error) error {
+		if !continueOnError {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+		failures = append(failures, &Failure{Source: source, Error: err.Error()})
+		return nil
+	}
+	generate := func(digest string, gen func() (*dagger.Directory, error)) (*dagger.Directory, error) {
+		if incremental {
+			dir, err := cachedDirectory(ctx, digest)
+			if err != nil || dir != nil {
+				return dir, err
+			}
+		}
+		dir, err := gen()
 		if err != nil {
 			return nil, err
 		}
-		entries, _ := mods.Entries(ctx)
+		if incremental {
+			return dir, cacheDirectory(ctx, digest, dir)
+		} else if continueOnError {
+			// force the evaluation so a failing source doesn't break the whole directory
+			_, err = dir.Sync(ctx)
+		}
+		return dir, err
+	}
+	// the k8s.io modules come first, the CRD modules may depend on them and are published after them
+	for i, s := range sources.Kubernetes {
+		source := fmt.Sprintf("kubernetes[%d] %s", i, s.Version)
+		schema, err := kubernetesSchemaDigest(ctx, s.Version)
+		if err != nil {
+			if err := fail(source, err); err != nil {
+				return nil, nil, nil, err
+			}
+			continue
+		}
+		digest, err := m.digest("kubernetes", s, schema)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		dir, err := generate(digest, func() (*dagger.Directory, error) {
+			return m.VendorKubernetes(s.Version, s.Include, s.Exclude)
+		})
+		if err != nil {
+			if err := fail(source, err); err != nil {
+				return nil, nil, nil, err
+			}
+			continue
+		}
+		ctr = ctr.WithDirectory("k8s.io-"+s.Version, dir.Directory("k8s.io-"+s.Version))
+		mods = append(mods, vendoredModule{Dir: "k8s.io-" + s.Version, Path: "k8s.io", Version: s.Version, Source: source, Digest: digest})
+	}
+	for i, s := range sources.Github {
+		source := fmt.Sprintf("github[%d] %s/%s@%s", i, s.Owner, s.Repo, s.Tag)
+		files, err := m.githubFiles(ctx, s.Tag, s.Ref, s.Owner, s.Repo, s.Files, s.Dirs, s.Assets)
+		if err != nil {
+			if err := fail(source, err); err != nil {
+				return nil, nil, nil, err
+			}
+			continue
+		}
+		contents, err := m.fileDigests(ctx, files)
+		if err != nil {
+			if err := fail(source, err); err != nil {
+				return nil, nil, nil, err
+			}
+			continue
+		}
+		digest, err := m.digest(s, contents)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		dir, err := generate(digest, func() (*dagger.Directory, error) {
+			return m.vendorCRDs(ctx, s.Tag, files, s.Kubernetes)
+		})
+		if err != nil {
+			if err := fail(source, err); err != nil {
+				return nil, nil, nil, err
+			}
+			continue
+		}
+		entries, err := dir.Entries(ctx)
+		if err != nil {
+			if err := fail(source, err); err != nil {
+				return nil, nil, nil, err
+			}
+			continue
+		}
 		for _, e := range entries {
-			ctr = ctr.WithDirectory(e, mods.Directory(e))
+			if other, ok := produced[e]; ok {
+				err := fmt.Errorf("module directory %s is already produced by %s", e, other)
+				if err := fail(source, err); err != nil {
+					return nil, nil, nil, err
+				}
+				continue
+			}
+			produced[e] = source
+			ctr = ctr.WithDirectory(e, dir.Directory(e))
+			mods = append(mods, vendoredModule{Dir: e, Path: strings.TrimSuffix(e, "-"+s.Tag), Version: s.Tag, Source: source, Digest: digest + "-" + e})
 		}
 	}
-	for _, s := range sources.Kubernetes {
-		mods := m.VendorKubernetes(s.Version)
-		ctr = ctr.WithDirectory("k8s.io-"+s.Version, mods.Directory("k8s.io-"+s.Version))
+	for i, s := range sources.Openapi {
+		source := fmt.Sprintf("openapi[%d] %s@%s", i, s.Module, s.Version)
+		document, err := m.download(s.URL).Digest(ctx)
+		if err != nil {
+			if err := fail(source, err); err != nil {
+				return nil, nil, nil, err
+			}
+			continue
+		}
+		digest, err := m.digest("openapi", s, document)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		dir, err := generate(digest, func() (*dagger.Directory, error) {
+			return m.VendorOpenapi(s.Module, s.Version, s.URL)
+		})
+		if err != nil {
+			if err := fail(source, err); err != nil {
+				return nil, nil, nil, err
+			}
+			continue
+		}
+		name := moduleDir(s.Module, s.Version)
+		ctr = ctr.WithDirectory(name, dir.Directory(name))
+		mods = append(mods, vendoredModule{Dir: name, Path: s.Module, Version: s.Version, Source: source, Digest: digest})
 	}
-	ctr = ctr.WithDirectory("timoni.sh-"+m.TimoniVersion, m.VendorTimoni().Directory("timoni.sh-"+m.TimoniVersion))
-	return ctr.Directory("."), nil
+	for i, s := range sources.timoni(m.TimoniVersion) {
+		source := fmt.Sprintf("timoni[%d] %s", i, s.Version)
+		// the schemas are embedded in the timoni binary of that version
+		digest, err := m.digest("timoni", s)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		dir, err := generate(digest, func() (*dagger.Directory, error) {
+			return m.VendorTimoni(s.Version)
+		})
+		if err != nil {
+			if err := fail(source, err); err != nil {
+				return nil, nil, nil, err
+			}
+			continue
+		}
+		ctr = ctr.WithDirectory("timoni.sh-"+s.Version, dir.Directory("timoni.sh-"+s.Version))
+		mods = append(mods, vendoredModule{Dir: "timoni.sh-" + s.Version, Path: "timoni.sh", Version: s.Version, Source: source, Digest: digest})
+	}
+	return ctr.Directory("."), mods, failures, nil
+}
+
+// vendor CUE schemas from a sources file
+func (m *CueSchemas) Vendor(
+	ctx context.Context,
+	file *dagger.File,
+	// +optional
+	// vendor the remaining sources when one fails and write the failures to failures.json
+	continueOnError bool,
+	// +optional
+	// reuse modules generated from the same inputs and tool versions from the cache volume
+	incremental bool,
+) (*dagger.Directory, error) {
+	_, sources, err := m.sources(ctx, file, false)
+	if err != nil {
+		return nil, err
+	}
+	dir, _, failures, err := m.vendor(ctx, sources, continueOnError, incremental)
+	if err != nil {
+		return nil, err
+	}
+	if len(failures) > 0 {
+		report, err := json.Marshal(failures)
+		if err != nil {
+			return nil, err
+		}
+		dir = dir.WithNewFile("failures.json", string(report))
+	}
+	return dir, nil
 }
 
-// publish CUE schemas from a sources.yaml file
+// publish CUE schemas from a sources file
 func (m *CueSchemas) Publish(
 	ctx context.Context,
 	file *dagger.File,
@@ -203,8 +599,7 @@ func (m *CueSchemas) Publish(
 	// the registry URL
 	registry string,
 	// +optional
-	// +default="derp"
-	// the registry username
+	// the registry username, required with password
 	username string,
 	// +optional
 	// the registry password
@@ -212,44 +607,95 @@ func (m *CueSchemas) Publish(
 	// +optional
 	// the registry service
 	service *dagger.Service,
+	// +optional
+	// the registry bearer token
+	token *dagger.Secret,
+	// +optional
+	// access the registry over plain HTTP
+	insecure bool,
+	// +optional
+	// publish the remaining sources when one fails and append the failures to the output
+	continueOnError bool,
+	// +optional
+	// reuse modules generated from the same inputs and skip the module versions already in the registry
+	incremental bool,
 ) (string, error) {
-	dir, err := m.Vendor(ctx, file)
+	_, sources, err := m.sources(ctx, file, false)
+	if err != nil {
+		return "", err
+	}
+	registries, err := m.registries(registry, username, password, token, service, insecure)
+	if err != nil {
+		return "", err
+	}
+	lookup, err := withRegistries(ctx, craneContainer(), registries)
 	if err != nil {
 		return "", err
 	}
-	mods, _ := dir.Entries(ctx)
-	ctr := m.Container().WithEnvVariable("CUE_REGISTRY", registry)
-	if registry == "" && service == nil {
-		return "", fmt.Errorf("one of registry or service is required")
-	} else if registry == "" {
-		endpoint, _ := service.Endpoint(ctx)
-		ctr = ctr.WithServiceBinding("registry", service).
-			WithEnvVariable("CUE_REGISTRY", fmt.Sprintf("%s+insecure", endpoint))
-	}
-	if password != nil {
-		docker := dag.Container().
-			From("docker").
-			WithSecretVariable("REGISTRY_PASSWORD", password).
-			WithExec([]string{"sh", "-c", fmt.Sprintf("docker login -u %s -p $REGISTRY_PASSWORD %s", username, registry)}).
-			File("/root/.docker/config.json")
-		ctr = ctr.WithFile("/root/.docker/config.json", docker)
+	if err := kubernetesDependencies(ctx, lookup, registries, sources); err != nil {
+		return "", err
 	}
+	dir, mods, failures, err := m.vendor(ctx, sources, continueOnError, incremental)
+	if err != nil {
+		return "", err
+	}
+	address, err := cueRegistry(ctx, registries)
+	if err != nil {
+		return "", err
+	}
+	ctr, err := withRegistries(ctx, m.Container(), registries)
+	if err != nil {
+		return "", err
+	}
+	ctr = ctr.WithEnvVariable("CUE_REGISTRY", address)
 	var result string
-	for _, m := range mods {
-		parts := strings.Split(m, "-")
-		version := parts[len(parts)-1]
-		stdout, err := ctr.WithDirectory(m, dir.Directory(m)).
-			WithWorkdir(m).
-			WithExec([]string{"cue", "mod", "publish", version}).
+	for _, mod := range mods {
+		if incremental {
+			ok, err := published(ctx, lookup, registries, mod.Path, mod.Version)
+			if err != nil {
+				return result, err
+			}
+			if ok {
+				result += fmt.Sprintf("skipped %s: already published\n", mod.Dir)
+				continue
+			}
+		}
+		stdout, err := ctr.WithDirectory(mod.Dir, dir.Directory(mod.Dir)).
+			WithWorkdir(mod.Dir).
+			WithExec([]string{"cue", "mod", "publish", mod.Version}).
 			Stdout(ctx)
 		if err != nil {
-			return result, err
+			if !continueOnError {
+				return result, fmt.Errorf("%s: %s: %w", mod.Source, mod.Dir, err)
+			}
+			failures = append(failures, &Failure{Source: mod.Source, Error: fmt.Sprintf("%s: %s", mod.Dir, err)})
+			continue
 		}
 		result += stdout
 	}
+	for _, f := range failures {
+		result += fmt.Sprintf("failed %s: %s\n", f.Source, f.Error)
+	}
 	return result, nil
 }
 
+// checks that the k8s.io modules the CRD modules depend on are vendored by the sources or already published
+func kubernetesDependencies(ctx context.Context, lookup *dagger.Container, registries []*Registry, sources *Sources) error {
+	for i, s := range sources.Github {
+		if s.Kubernetes == "" || slices.ContainsFunc(sources.Kubernetes, func(k KubernetesSource) bool { return k.Version == s.Kubernetes }) {
+			continue
+		}
+		ok, err := published(ctx, lookup, registries, "k8s.io", s.Kubernetes)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("github[%d] %s/%s@%s: k8s.io@%s is neither vendored nor published", i, s.Owner, s.Repo, s.Tag, s.Kubernetes)
+		}
+	}
+	return nil
+}
+
 // export Kubernetes CRDs from GitHub
 func (m *CueSchemas) ExportGithub(
 	ctx context.Context,
@@ -272,46 +718,24 @@ func (m *CueSchemas) ExportGithub(
 	// the repo release assets to vendor
 	asset []string,
 ) (*dagger.File, error) {
-	client := github.NewClient(nil)
-	if ref == "" {
-		ref = tag
-	}
-	var files []string
-	for _, f := range file {
-		files = append(files, fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/refs/tags/%s/%s", owner, repo, ref, f))
-	}
-	for _, d := range dir {
-		_, entries, _, err := client.Repositories.GetContents(ctx, owner, repo, d, &github.RepositoryContentGetOptions{Ref: ref})
-		if err != nil {
-			return nil, err
-		}
-		for _, e := range entries {
-			if strings.HasSuffix(e.GetName(), ".yml") || strings.HasSuffix(e.GetName(), ".yaml") {
-				files = append(files, e.GetDownloadURL())
-			}
-		}
-	}
-	for _, a := range asset {
-		files = append(files, fmt.Sprintf("https://github.com/%s/%s/releases/download/%s/%s", owner, repo, ref, a))
+	files, err := m.githubFiles(ctx, tag, ref, owner, repo, file, dir, asset)
+	if err != nil {
+		return nil, err
 	}
 	ctr := m.Container().
 		WithWorkdir("/tmp/gen")
-	for _, f := range files {
-		ctr = ctr.WithExec([]string{"wget", f})
+	for i, f := range files {
+		ctr = ctr.WithFile(fmt.Sprintf("%d-%s", i, path.Base(f.URL)), m.download(f.URL))
 	}
 	ctr = ctr.WithExec([]string{"cue", "import", "-fl", "strings.ToLower(kind)", "-l", "strings.ToLower(metadata.name)", "-p", "crds"}).
 		WithExec([]string{"cue", "export", "-e", "customresourcedefinition", "-o", "crds.cue"})
 	return ctr.File("crds.cue"), nil
 }
 
-// export Kubernetes CRDs from a sources.yaml file
+// export Kubernetes CRDs from a sources file
 func (m *CueSchemas) Export(ctx context.Context, file *dagger.File) (*dagger.Directory, error) {
-	if err := m.Validate(ctx, file); err != nil {
-		return nil, err
-	}
-	contents, _ := file.Contents(ctx)
-	var sources Sources
-	if err := yamlv3.Unmarshal([]byte(contents), &sources); err != nil {
+	_, sources, err := m.sources(ctx, file, false)
+	if err != nil {
 		return nil, err
 	}
 	ctr := dag.Container()
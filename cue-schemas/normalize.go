@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"dagger/cue-schemas/internal/dagger"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// converts an apiextensions.k8s.io/v1beta1 CustomResourceDefinition to apiextensions.k8s.io/v1
+func convertCRD(crd map[string]any) {
+	crd["apiVersion"] = "apiextensions.k8s.io/v1"
+	spec, _ := crd["spec"].(map[string]any)
+	if spec == nil {
+		return
+	}
+	versions, _ := spec["versions"].([]any)
+	if len(versions) == 0 {
+		if name, ok := spec["version"].(string); ok {
+			versions = []any{map[string]any{"name": name, "served": true, "storage": true}}
+		}
+	}
+	// the schema, subresources and printer columns are per version in v1
+	var schema map[string]any
+	if validation, ok := spec["validation"].(map[string]any); ok {
+		schema, _ = validation["openAPIV3Schema"].(map[string]any)
+	}
+	if preserve, _ := spec["preserveUnknownFields"].(bool); preserve {
+		if schema == nil {
+			schema = map[string]any{"type": "object"}
+		}
+		schema["x-kubernetes-preserve-unknown-fields"] = true
+	}
+	for _, v := range versions {
+		version, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		if _, ok := version["schema"]; !ok {
+			if schema != nil {
+				version["schema"] = map[string]any{"openAPIV3Schema": schema}
+			} else {
+				version["schema"] = map[string]any{"openAPIV3Schema": map[string]any{
+					"type":                                 "object",
+					"x-kubernetes-preserve-unknown-fields": true,
+				}}
+			}
+		}
+		if _, ok := version["subresources"]; !ok && spec["subresources"] != nil {
+			version["subresources"] = spec["subresources"]
+		}
+		if _, ok := version["additionalPrinterColumns"]; !ok && spec["additionalPrinterColumns"] != nil {
+			version["additionalPrinterColumns"] = spec["additionalPrinterColumns"]
+		}
+		if columns, ok := version["additionalPrinterColumns"].([]any); ok {
+			converted := make([]any, 0, len(columns))
+			for _, c := range columns {
+				column, ok := c.(map[string]any)
+				if !ok {
+					continue
+				}
+				out := map[string]any{}
+				for k, v := range column {
+					if k == "JSONPath" {
+						k = "jsonPath"
+					}
+					out[k] = v
+				}
+				converted = append(converted, out)
+			}
+			version["additionalPrinterColumns"] = converted
+		}
+	}
+	spec["versions"] = versions
+	for _, k := range []string{"version", "validation", "subresources", "additionalPrinterColumns", "preserveUnknownFields"} {
+		delete(spec, k)
+	}
+	if conversion, ok := spec["conversion"].(map[string]any); ok && conversion["strategy"] == "Webhook" {
+		webhook := map[string]any{}
+		if cfg, ok := conversion["webhookClientConfig"]; ok {
+			webhook["clientConfig"] = cfg
+		}
+		if versions, ok := conversion["conversionReviewVersions"]; ok {
+			webhook["conversionReviewVersions"] = versions
+		} else {
+			webhook["conversionReviewVersions"] = []any{"v1beta1"}
+		}
+		spec["conversion"] = map[string]any{"strategy": "Webhook", "webhook": webhook}
+	}
+}
+
+// converts the v1beta1 CustomResourceDefinitions in a multi-document YAML file to v1
+func normalizeCRDs(contents string) (string, bool, error) {
+	dec := yaml.NewDecoder(strings.NewReader(contents))
+	var docs []map[string]any
+	changed := false
+	for {
+		var doc map[string]any
+		if err := dec.Decode(&doc); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return "", false, err
+		}
+		if doc == nil {
+			continue
+		}
+		if doc["apiVersion"] == "apiextensions.k8s.io/v1beta1" && doc["kind"] == "CustomResourceDefinition" {
+			convertCRD(doc)
+			changed = true
+		}
+		docs = append(docs, doc)
+	}
+	if !changed {
+		return contents, false, nil
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	for _, doc := range docs {
+		if err := enc.Encode(doc); err != nil {
+			return "", false, err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return "", false, err
+	}
+	return buf.String(), true, nil
+}
+
+// downloads the files to vendor into the container, converting v1beta1 CRDs to v1, and returns their paths
+func (m *CueSchemas) withCRDs(ctx context.Context, ctr *dagger.Container, files []githubFile) (*dagger.Container, []string, error) {
+	var paths []string
+	urls := map[string]string{}
+	for i, f := range files {
+		p := fmt.Sprintf("/tmp/crds/%d-%s", i, path.Base(f.URL))
+		ctr = ctr.WithFile(p, m.download(f.URL))
+		paths = append(paths, p)
+		urls[p] = f.URL
+	}
+	if len(paths) == 0 {
+		return ctr, paths, nil
+	}
+	// only the legacy files are read into the module to be converted, the others stay in the container
+	legacy, err := ctr.WithExec(append([]string{"grep", "-l", "apiextensions.k8s.io/v1beta1"}, paths...),
+		dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range strings.Split(strings.TrimSpace(legacy), "\n") {
+		if p == "" {
+			continue
+		}
+		contents, err := ctr.File(p).Contents(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", urls[p], err)
+		}
+		normalized, changed, err := normalizeCRDs(contents)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", urls[p], err)
+		}
+		if changed {
+			ctr = ctr.WithNewFile(p, normalized)
+		}
+	}
+	return ctr, paths, nil
+}
+
+// returns the directory a module version is vendored to, module paths with slashes are flattened
+func moduleDir(module string, version string) string {
+	return strings.ReplaceAll(module, "/", "_") + "-" + version
+}
+
+var packageRegexp = regexp.MustCompile(`[^a-z0-9_]`)
+
+// vendor CUE schemas from a standalone OpenAPI v3 document
+func (m *CueSchemas) VendorOpenapi(
+	// the module path (e.g. example.com/api)
+	module string,
+	// the module version
+	version string,
+	// the URL of the OpenAPI v3 document (JSON or YAML)
+	url string,
+) (*dagger.Directory, error) {
+	semver, err := semver.NewVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	pkg := packageRegexp.ReplaceAllString(strings.ToLower(path.Base(module)), "_")
+	dir := m.Container().
+		WithWorkdir("/tmp/gen").
+		WithFile("/tmp/openapi/"+path.Base(url), m.download(url)).
+		WithExec([]string{"cue", "import", "-p", pkg, "-o", "openapi_gen.cue", "openapi:", "/tmp/openapi/" + path.Base(url)}).
+		WithExec([]string{"cue", "mod", "init", fmt.Sprintf("%s@v%d", module, semver.Major()), "--source=self"}).
+		Directory(".")
+	return dag.Container().
+		WithDirectory(moduleDir(module, version), dir).
+		Directory("."), nil
+}
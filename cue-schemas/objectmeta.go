@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"dagger/cue-schemas/internal/dagger"
+	"fmt"
+	"path"
+	"strings"
+
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/format"
+	"cuelang.org/go/cue/parser"
+	"cuelang.org/go/cue/token"
+	"github.com/Masterminds/semver/v3"
+)
+
+// replaces the inline ObjectMeta of the top-level definitions in a generated CRD schema
+// with the one from the k8s.io module, keeping the required name and namespace fields
+func importObjectMeta(filename string, src string) (string, bool, error) {
+	f, err := parser.ParseFile(filename, src, parser.ParseComments)
+	if err != nil {
+		return "", false, err
+	}
+	changed := false
+	for _, decl := range f.Decls {
+		def, ok := decl.(*ast.Field)
+		if !ok {
+			continue
+		}
+		st, ok := def.Value.(*ast.StructLit)
+		if !ok {
+			continue
+		}
+		for _, elt := range st.Elts {
+			field, ok := elt.(*ast.Field)
+			if !ok {
+				continue
+			}
+			if name, _, _ := ast.LabelName(field.Label); name != "metadata" {
+				continue
+			}
+			meta, ok := field.Value.(*ast.StructLit)
+			if !ok {
+				continue
+			}
+			var keep []ast.Decl
+			for _, e := range meta.Elts {
+				if f, ok := e.(*ast.Field); ok {
+					if name, _, _ := ast.LabelName(f.Label); name == "name" || name == "namespace" {
+						keep = append(keep, f)
+					}
+				}
+			}
+			rest := &ast.StructLit{Elts: keep}
+			ast.SetRelPos(rest, token.Blank)
+			field.Value = &ast.BinaryExpr{
+				X:  ast.NewSel(ast.NewIdent("metav1"), "#ObjectMeta"),
+				Op: token.AND,
+				Y:  rest,
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return src, false, nil
+	}
+	imp := &ast.ImportDecl{Specs: []*ast.ImportSpec{
+		ast.NewImport(ast.NewIdent("metav1"), "k8s.io/apimachinery/pkg/apis/meta/v1"),
+	}}
+	i := 0
+	for j, decl := range f.Decls {
+		switch decl.(type) {
+		case *ast.Package, *ast.ImportDecl:
+			i = j + 1
+		}
+	}
+	f.Decls = append(f.Decls[:i], append([]ast.Decl{imp}, f.Decls[i:]...)...)
+	out, err := format.Node(f)
+	if err != nil {
+		return "", false, err
+	}
+	return string(out), true, nil
+}
+
+// rewrites the generated CRD schemas in a module directory to import ObjectMeta from the k8s.io module
+// and records the dependency in the module file
+func withObjectMetaImport(ctx context.Context, ctr *dagger.Container, dir string, kubernetesVersion string) (*dagger.Container, error) {
+	version, err := semver.NewVersion(kubernetesVersion)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ctr.Directory(dir).Glob(ctx, "**/*.cue")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f, "cue.mod/") {
+			continue
+		}
+		contents, err := ctr.File(path.Join(dir, f)).Contents(ctx)
+		if err != nil {
+			return nil, err
+		}
+		out, changed, err := importObjectMeta(f, contents)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path.Join(dir, f), err)
+		}
+		if changed {
+			ctr = ctr.WithNewFile(path.Join(dir, f), out)
+		}
+	}
+	module, err := ctr.File(path.Join(dir, "cue.mod/module.cue")).Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	module += fmt.Sprintf("deps: {\n\t\"k8s.io@v%d\": {\n\t\tv: %q\n\t}\n}\n", version.Major(), kubernetesVersion)
+	return ctr.WithNewFile(path.Join(dir, "cue.mod/module.cue"), module), nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"dagger/cue-schemas/internal/dagger"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// delete old module versions from the registry
+func (m *CueSchemas) Prune(
+	ctx context.Context,
+	// +optional
+	// the module paths to prune (e.g. k8s.io)
+	module []string,
+	// +optional
+	// keep the module versions referenced by this sources file and prune its modules too
+	file *dagger.File,
+	// +optional
+	// +default=3
+	// the number of patch versions to keep per minor version
+	keepLast int,
+	// +optional
+	// only report what would be deleted
+	dryRun bool,
+	// +optional
+	// the registry URL
+	registry string,
+	// +optional
+	// the registry username, required with password
+	username string,
+	// +optional
+	// the registry password
+	password *dagger.Secret,
+	// +optional
+	// the registry service
+	service *dagger.Service,
+	// +optional
+	// the registry bearer token
+	token *dagger.Secret,
+	// +optional
+	// access the registry over plain HTTP
+	insecure bool,
+) (string, error) {
+	if keepLast < 1 {
+		return "", fmt.Errorf("keepLast must be at least 1, got %d", keepLast)
+	}
+	registries, err := m.registries(registry, username, password, token, service, insecure)
+	if err != nil {
+		return "", err
+	}
+	if len(module) == 0 && file == nil {
+		return "", fmt.Errorf("one of module or file is required")
+	}
+	referenced := map[string]bool{}
+	if file != nil {
+		_, sources, err := m.sources(ctx, file, false)
+		if err != nil {
+			return "", err
+		}
+		mods, err := m.referencedModules(ctx, sources)
+		if err != nil {
+			return "", err
+		}
+		for _, mod := range mods {
+			if !slices.Contains(module, mod.Path) {
+				module = append(module, mod.Path)
+			}
+			referenced[mod.Path+":"+mod.Version] = true
+		}
+	}
+	ctr, err := withRegistries(ctx, craneContainer(), registries)
+	if err != nil {
+		return "", err
+	}
+	var result string
+	for _, path := range module {
+		r := registryFor(registries, path)
+		if r == nil {
+			return result, fmt.Errorf("no registry for module %s", path)
+		}
+		address, err := r.address(ctx)
+		if err != nil {
+			return result, err
+		}
+		var flags []string
+		if r.Insecure {
+			flags = append(flags, "--insecure")
+		}
+		repo := fmt.Sprintf("%s/%s", address, path)
+		versions, err := craneVersions(ctx, ctr, repo, flags)
+		if err != nil {
+			return result, err
+		}
+		// newest first, so the first keepLast versions of every minor are kept
+		slices.Reverse(versions)
+		kept := map[string]int{}
+		var keep, prune []string
+		for _, v := range versions {
+			sv := semver.MustParse(v)
+			minor := fmt.Sprintf("v%d.%d", sv.Major(), sv.Minor())
+			if kept[minor] < keepLast || referenced[path+":"+v] {
+				kept[minor]++
+				keep = append(keep, v)
+			} else {
+				prune = append(prune, v)
+			}
+		}
+		if len(prune) == 0 {
+			continue
+		}
+		// versions with identical contents share a manifest, deleting it would delete the kept tags too
+		digests := map[string]string{}
+		for _, v := range versions {
+			digest, err := ctr.WithExec(append([]string{"crane", "digest", fmt.Sprintf("%s:%s", repo, v)}, flags...)).
+				Stdout(ctx)
+			if err != nil {
+				return result, err
+			}
+			digests[v] = strings.TrimSpace(digest)
+		}
+		shared := map[string]string{}
+		for _, v := range keep {
+			shared[digests[v]] = v
+		}
+		for _, v := range prune {
+			if other, ok := shared[digests[v]]; ok {
+				result += fmt.Sprintf("kept %s:%s: shares its manifest with %s\n", path, v, other)
+				continue
+			}
+			if dryRun {
+				result += fmt.Sprintf("would delete %s:%s\n", path, v)
+				continue
+			}
+			_, err := ctr.WithExec(append([]string{"crane", "delete", fmt.Sprintf("%s@%s", repo, digests[v])}, flags...)).
+				Sync(ctx)
+			if err != nil {
+				return result, err
+			}
+			result += fmt.Sprintf("deleted %s:%s\n", path, v)
+		}
+	}
+	return result, nil
+}
+
+// returns the module paths and versions a sources file produces, reading the API groups of the CRDs instead of vendoring them
+func (m *CueSchemas) referencedModules(ctx context.Context, sources *Sources) ([]vendoredModule, error) {
+	var mods []vendoredModule
+	for i, s := range sources.Github {
+		source := fmt.Sprintf("github[%d] %s/%s@%s", i, s.Owner, s.Repo, s.Tag)
+		files, err := m.githubFiles(ctx, s.Tag, s.Ref, s.Owner, s.Repo, s.Files, s.Dirs, s.Assets)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		var groups []string
+		for _, f := range files {
+			contents, err := m.download(f.URL).Contents(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", source, f.URL, err)
+			}
+			found, err := crdGroups(contents)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", source, f.URL, err)
+			}
+			for _, g := range found {
+				if !slices.Contains(groups, g) {
+					groups = append(groups, g)
+				}
+			}
+		}
+		for _, g := range groups {
+			mods = append(mods, vendoredModule{Path: g, Version: s.Tag, Source: source})
+		}
+	}
+	for i, s := range sources.Kubernetes {
+		mods = append(mods, vendoredModule{Path: "k8s.io", Version: s.Version, Source: fmt.Sprintf("kubernetes[%d] %s", i, s.Version)})
+	}
+	for i, s := range sources.Openapi {
+		mods = append(mods, vendoredModule{Path: s.Module, Version: s.Version, Source: fmt.Sprintf("openapi[%d] %s@%s", i, s.Module, s.Version)})
+	}
+	for i, s := range sources.timoni(m.TimoniVersion) {
+		mods = append(mods, vendoredModule{Path: "timoni.sh", Version: s.Version, Source: fmt.Sprintf("timoni[%d] %s", i, s.Version)})
+	}
+	return mods, nil
+}
+
+// returns the API groups of the CustomResourceDefinitions in a multi-document YAML file
+func crdGroups(contents string) ([]string, error) {
+	dec := yaml.NewDecoder(strings.NewReader(contents))
+	var groups []string
+	for {
+		var doc struct {
+			Kind string `yaml:"kind"`
+			Spec struct {
+				Group string `yaml:"group"`
+			} `yaml:"spec"`
+		}
+		if err := dec.Decode(&doc); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if doc.Kind == "CustomResourceDefinition" && doc.Spec.Group != "" {
+			groups = append(groups, doc.Spec.Group)
+		}
+	}
+	return groups, nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"dagger/cue-schemas/internal/dagger"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// an OCI registry serving CUE modules
+type Registry struct {
+	// the module path prefix served by the registry, empty for the default registry
+	Prefix string
+	// the registry URL (e.g. ghcr.io/owner/repo)
+	URL string
+	// the registry username for basic auth
+	Username string
+	// +private
+	Password *dagger.Secret
+	// +private
+	Token *dagger.Secret
+	// +private
+	Service *dagger.Service
+	// whether the registry is accessed over plain HTTP
+	Insecure bool
+}
+
+// returns the registry URL, or the service endpoint if no URL is set
+func (r *Registry) address(ctx context.Context) (string, error) {
+	if r.URL != "" {
+		return r.URL, nil
+	}
+	if r.Service == nil {
+		return "", fmt.Errorf("one of registry or service is required")
+	}
+	return r.Service.Endpoint(ctx)
+}
+
+// add a registry for the modules under a path prefix
+func (m *CueSchemas) WithRegistry(
+	// +optional
+	// the module path prefix served by the registry (e.g. k8s.io), empty for the default registry
+	prefix string,
+	// +optional
+	// the registry URL
+	url string,
+	// +optional
+	// the registry username, required with password
+	username string,
+	// +optional
+	// the registry password
+	password *dagger.Secret,
+	// +optional
+	// the registry bearer token
+	token *dagger.Secret,
+	// +optional
+	// the registry service
+	service *dagger.Service,
+	// +optional
+	// access the registry over plain HTTP
+	insecure bool,
+) *CueSchemas {
+	m.Registries = append(m.Registries, &Registry{
+		Prefix:   prefix,
+		URL:      url,
+		Username: username,
+		Password: password,
+		Token:    token,
+		Service:  service,
+		Insecure: insecure || (url == "" && service != nil),
+	})
+	return m
+}
+
+// returns the configured registries, with the given registry replacing the default one
+func (m *CueSchemas) registries(registry string, username string, password *dagger.Secret, token *dagger.Secret, service *dagger.Service, insecure bool) ([]*Registry, error) {
+	var registries []*Registry
+	for _, r := range m.Registries {
+		if r.Prefix != "" || (registry == "" && service == nil) {
+			registries = append(registries, r)
+		}
+	}
+	if registry != "" || service != nil {
+		registries = append(registries, &Registry{
+			URL:      registry,
+			Username: username,
+			Password: password,
+			Token:    token,
+			Service:  service,
+			Insecure: insecure || (registry == "" && service != nil),
+		})
+	}
+	if len(registries) == 0 {
+		return nil, fmt.Errorf("one of registry, service or withRegistry is required")
+	}
+	return registries, nil
+}
+
+// returns the registry serving a module path, preferring the longest matching prefix
+func registryFor(registries []*Registry, path string) *Registry {
+	var match *Registry
+	for _, r := range registries {
+		if r.Prefix != "" && path != r.Prefix && !strings.HasPrefix(path, r.Prefix+"/") {
+			continue
+		}
+		if match == nil || len(r.Prefix) > len(match.Prefix) {
+			match = r
+		}
+	}
+	return match
+}
+
+// returns the CUE_REGISTRY value for the registries
+func cueRegistry(ctx context.Context, registries []*Registry) (string, error) {
+	var entries []string
+	for _, r := range registries {
+		address, err := r.address(ctx)
+		if err != nil {
+			return "", err
+		}
+		if r.Insecure {
+			address += "+insecure"
+		}
+		if r.Prefix != "" {
+			address = r.Prefix + "=" + address
+		}
+		entries = append(entries, address)
+	}
+	return strings.Join(entries, ","), nil
+}
+
+// binds the registry services to the container and mounts a docker config.json with the registry credentials
+func withRegistries(ctx context.Context, ctr *dagger.Container, registries []*Registry) (*dagger.Container, error) {
+	type auth struct {
+		Auth          string `json:"auth,omitempty"`
+		RegistryToken string `json:"registrytoken,omitempty"`
+	}
+	auths := map[string]auth{}
+	var hosts []string
+	for i, r := range registries {
+		address, err := r.address(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if r.Service != nil {
+			ctr = ctr.WithServiceBinding(fmt.Sprintf("registry-%d", i), r.Service)
+		}
+		host, _, _ := strings.Cut(address, "/")
+		switch {
+		case r.Token != nil:
+			token, err := r.Token.Plaintext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			auths[host] = auth{RegistryToken: token}
+		case r.Password != nil:
+			if r.Username == "" {
+				return nil, fmt.Errorf("registry %s: a password requires a username", address)
+			}
+			password, err := r.Password.Plaintext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			auths[host] = auth{Auth: base64.StdEncoding.EncodeToString([]byte(r.Username + ":" + password))}
+		default:
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	if len(auths) == 0 {
+		return ctr, nil
+	}
+	config, err := json.Marshal(map[string]any{"auths": auths})
+	if err != nil {
+		return nil, err
+	}
+	secret := dag.SetSecret(fmt.Sprintf("cue-schemas-docker-config-%s", strings.Join(hosts, ",")), string(config))
+	return ctr.WithMountedSecret("/root/.docker/config.json", secret), nil
+}
+
+// returns a container with the crane binary
+func craneContainer() *dagger.Container {
+	return dag.Container().
+		From("gcr.io/go-containerregistry/crane:debug").
+		WithEnvVariable("DOCKER_CONFIG", "/root/.docker")
+}
+
+// lists the semver tags of a repository in ascending order
+func craneVersions(ctx context.Context, ctr *dagger.Container, repo string, flags []string) ([]string, error) {
+	stdout, err := ctr.WithExec(append([]string{"crane", "ls", repo}, flags...)).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, tag := range strings.Fields(stdout) {
+		if _, err := semver.NewVersion(tag); err == nil {
+			versions = append(versions, tag)
+		}
+	}
+	slices.SortFunc(versions, func(a, b string) int {
+		return semver.MustParse(a).Compare(semver.MustParse(b))
+	})
+	return versions, nil
+}
+
+// mirror CUE modules from one registry to another
+func (m *CueSchemas) Mirror(
+	ctx context.Context,
+	// the modules to mirror, as path or path:version (e.g. k8s.io:v1.31.4)
+	module []string,
+	// +optional
+	// the semver constraint for modules without a version (e.g. ">=1.31.0"), all versions if empty
+	constraint string,
+	// +optional
+	// the source registry URL
+	src string,
+	// +optional
+	// the source registry username, required with src-password
+	srcUsername string,
+	// +optional
+	// the source registry password
+	srcPassword *dagger.Secret,
+	// +optional
+	// the source registry bearer token
+	srcToken *dagger.Secret,
+	// +optional
+	// the source registry service
+	srcService *dagger.Service,
+	// +optional
+	// access the source registry over plain HTTP
+	srcInsecure bool,
+	// +optional
+	// the destination registry URL
+	dst string,
+	// +optional
+	// the destination registry username, required with dst-password
+	dstUsername string,
+	// +optional
+	// the destination registry password
+	dstPassword *dagger.Secret,
+	// +optional
+	// the destination registry bearer token
+	dstToken *dagger.Secret,
+	// +optional
+	// the destination registry service
+	dstService *dagger.Service,
+	// +optional
+	// access the destination registry over plain HTTP
+	dstInsecure bool,
+) (string, error) {
+	from := &Registry{URL: src, Username: srcUsername, Password: srcPassword, Token: srcToken, Service: srcService,
+		Insecure: srcInsecure || (src == "" && srcService != nil)}
+	to := &Registry{URL: dst, Username: dstUsername, Password: dstPassword, Token: dstToken, Service: dstService,
+		Insecure: dstInsecure || (dst == "" && dstService != nil)}
+	var c *semver.Constraints
+	if constraint != "" {
+		var err error
+		if c, err = semver.NewConstraint(constraint); err != nil {
+			return "", err
+		}
+	}
+	srcAddress, err := from.address(ctx)
+	if err != nil {
+		return "", fmt.Errorf("src: %w", err)
+	}
+	dstAddress, err := to.address(ctx)
+	if err != nil {
+		return "", fmt.Errorf("dst: %w", err)
+	}
+	ctr, err := withRegistries(ctx, craneContainer(), []*Registry{from, to})
+	if err != nil {
+		return "", err
+	}
+	var flags []string
+	if from.Insecure || to.Insecure {
+		flags = append(flags, "--insecure")
+	}
+	var result string
+	for _, mod := range module {
+		path, version, _ := strings.Cut(mod, ":")
+		versions := []string{version}
+		if version == "" {
+			all, err := craneVersions(ctx, ctr, fmt.Sprintf("%s/%s", srcAddress, path), flags)
+			if err != nil {
+				return result, err
+			}
+			versions = nil
+			for _, v := range all {
+				if c == nil || c.Check(semver.MustParse(v)) {
+					versions = append(versions, v)
+				}
+			}
+		}
+		for _, v := range versions {
+			srcRef := fmt.Sprintf("%s/%s:%s", srcAddress, path, v)
+			dstRef := fmt.Sprintf("%s/%s:%s", dstAddress, path, v)
+			_, err := ctr.WithExec(append([]string{"crane", "copy", srcRef, dstRef}, flags...)).
+				Sync(ctx)
+			if err != nil {
+				return result, err
+			}
+			result += fmt.Sprintf("%s -> %s\n", srcRef, dstRef)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"dagger/cue-schemas/internal/dagger"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	moduleRegexp      = regexp.MustCompile(`(?m)^module:\s*"([^"@]+)(?:@v\d+)?"`)
+	kubeVersionRegexp = regexp.MustCompile(`^v(\d+)(?:(alpha|beta)(\d+))?$`)
+)
+
+// orders Kubernetes API versions by stability, e.g. v1alpha1 < v1beta1 < v1 < v2beta1 < v2
+func compareKubeVersions(a string, b string) int {
+	rank := func(v string) []int {
+		m := kubeVersionRegexp.FindStringSubmatch(v)
+		if m == nil {
+			return []int{-1, 0, 0}
+		}
+		major, _ := strconv.Atoi(m[1])
+		stability := map[string]int{"alpha": 0, "beta": 1, "": 2}[m[2]]
+		minor, _ := strconv.Atoi(m[3])
+		return []int{major, stability, minor}
+	}
+	return slices.Compare(rank(a), rank(b))
+}
+
+// generate a Timoni module that renders custom resources of a kind from a vendored CRD module
+func (m *CueSchemas) ScaffoldTimoni(
+	ctx context.Context,
+	// the vendored CRD module directory
+	source *dagger.Directory,
+	// the kind to render (e.g. GitRepository)
+	kind string,
+	// +optional
+	// the API version of the kind (e.g. v1), the most stable one if empty
+	version string,
+	// +optional
+	// the Timoni module name, the lowercase kind if empty
+	name string,
+) (*dagger.Directory, error) {
+	if name == "" {
+		name = strings.ToLower(kind)
+	}
+	module, err := source.File("cue.mod/module.cue").Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	match := moduleRegexp.FindStringSubmatch(module)
+	if match == nil {
+		return nil, fmt.Errorf("no module path in cue.mod/module.cue")
+	}
+	modulePath := match[1]
+	files, err := source.Glob(ctx, "**/*.cue")
+	if err != nil {
+		return nil, err
+	}
+	kindRegexp := regexp.MustCompile(fmt.Sprintf(`(?m)^\s*kind:\s*"%s"`, regexp.QuoteMeta(kind)))
+	var pkg, contents string
+	for _, f := range files {
+		if strings.HasPrefix(f, "cue.mod/") {
+			continue
+		}
+		v := path.Base(path.Dir(f))
+		if version != "" && v != version {
+			continue
+		}
+		if pkg != "" && compareKubeVersions(v, path.Base(pkg)) <= 0 {
+			continue
+		}
+		c, err := source.File(f).Contents(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if kindRegexp.MatchString(c) {
+			pkg, contents = path.Dir(f), c
+		}
+	}
+	if pkg == "" {
+		return nil, fmt.Errorf("kind %s not found in module %s", kind, modulePath)
+	}
+	alias := strings.ToLower(kind) + path.Base(pkg)
+	importPath := path.Join(modulePath, pkg)
+	namespaced := strings.Contains(contents, "namespace!:")
+	hasSpec := strings.Contains(contents, fmt.Sprintf("#%sSpec:", kind))
+
+	config := fmt.Sprintf(`package templates
+
+import (
+	timoniv1 "timoni.sh/core/v1alpha1"
+	%[1]s "%[2]s"
+)
+
+// #Config defines the schema and defaults for the Instance values.
+#Config: {
+	// The kubeVersion is a required field, set at apply-time
+	// via timoni.cue by querying the user's Kubernetes API.
+	kubeVersion!: string
+	// Using the kubeVersion you can enforce a minimum Kubernetes minor version.
+	// By default, the minimum Kubernetes version is set to 1.20.
+	clusterVersion: timoniv1.#SemVer & {#Version: kubeVersion, #Minimum: "1.20.0"}
+
+	// The moduleVersion is set from the user-supplied module version.
+	// This field is used for the app.kubernetes.io/version label.
+	moduleVersion!: string
+
+	// The Kubernetes metadata common to all resources.
+	// The metadata.name and metadata.namespace fields are
+	// set from the user-supplied instance name and namespace.
+	metadata: timoniv1.#Metadata & {#Version: moduleVersion}
+
+	// The labels allows adding metadata.labels to all resources.
+	// The app.kubernetes.io/name and app.kubernetes.io/version labels
+	// are automatically generated and can't be overwritten.
+	metadata: labels: timoniv1.#Labels
+
+	// The annotations allows adding metadata.annotations to all resources.
+	metadata: annotations?: timoniv1.#Annotations
+`, alias, importPath)
+	if hasSpec {
+		config += fmt.Sprintf(`
+	// The spec of the %[1]s resource.
+	spec: %[2]s.#%[1]sSpec
+`, kind, alias)
+	}
+	config += fmt.Sprintf(`}
+
+// #Instance takes the config values and outputs the Kubernetes objects.
+#Instance: {
+	config: #Config
+
+	objects: {
+		%[1]s: #%[2]s & {#config: config}
+	}
+}
+`, strings.ToLower(kind), kind)
+
+	metadata := "\t\tname: #config.metadata.name\n"
+	if namespaced {
+		metadata += "\t\tnamespace: #config.metadata.namespace\n"
+	}
+	metadata += "\t\tlabels: #config.metadata.labels\n" +
+		"\t\tif #config.metadata.annotations != _|_ {\n\t\t\tannotations: #config.metadata.annotations\n\t\t}\n"
+	template := fmt.Sprintf(`package templates
+
+import (
+	%[1]s "%[2]s"
+)
+
+#%[3]s: %[1]s.#%[3]s & {
+	#config: #Config
+	metadata: {
+%[4]s	}
+`, alias, importPath, kind, metadata)
+	if hasSpec {
+		template += "\tspec: #config.spec\n"
+	}
+	template += "}\n"
+
+	values := `// Note that this file must have no imports and all values must be concrete.
+
+@if(!debug)
+
+package main
+
+// Defaults
+values: {
+`
+	if hasSpec {
+		values += fmt.Sprintf("\t// The %s spec, see %s.#%sSpec.\n\tspec: {}\n", kind, importPath, kind)
+	}
+	values += "}\n"
+
+	debugValues := `@if(debug)
+
+package main
+
+// Values used by debug_tool.cue.
+// Debug example 'cue cmd -t debug -t name=test -t namespace=test -t mv=1.0.0 -t kv=1.28.0 build'.
+values: {
+`
+	if hasSpec {
+		debugValues += "\tspec: {}\n"
+	}
+	debugValues += "}\n"
+
+	// the starter timoni.cue runs the tests of the starter templates, which the scaffold doesn't have
+	timoni := fmt.Sprintf(`// Note that this file is required and should contain
+// the values schema and the timoni workflow.
+
+package main
+
+import (
+	templates "timoni.sh/%s/templates"
+)
+
+// Define the schema for the user-supplied values.
+// At runtime, Timoni injects the supplied values
+// and validates them according to the Config schema.
+values: templates.#Config
+
+// Define how Timoni should build, validate and
+// apply the Kubernetes resources.
+timoni: {
+	apiVersion: "v1alpha1"
+
+	// Define the instance that outputs the Kubernetes resources.
+	// At runtime, Timoni builds the instance and validates
+	// the resulting resources according to their Kubernetes schema.
+	instance: templates.#Instance & {
+		// The user-supplied values are merged with the
+		// default values at runtime by Timoni.
+		config: values
+		// These values are injected at runtime by Timoni.
+		config: {
+			metadata: {
+				name:      string @tag(name)
+				namespace: string @tag(namespace)
+			}
+			moduleVersion: string @tag(mv, var=moduleVersion)
+			kubeVersion:   string @tag(kv, var=kubeVersion)
+		}
+	}
+
+	// Pass Kubernetes resources outputted by the instance
+	// to Timoni's multi-step apply.
+	apply: app: [for obj in instance.objects {obj}]
+}
+`, name)
+
+	debugTool := `package main
+
+import (
+	"tool/cli"
+	"encoding/yaml"
+	"text/tabwriter"
+)
+
+_resources: timoni.apply.app
+
+// The build command generates the Kubernetes manifests and prints the multi-docs YAML to stdout.
+// Example 'cue cmd -t debug -t name=test -t namespace=test -t mv=1.0.0 -t kv=1.28.0 build'.
+command: build: {
+	task: print: cli.Print & {
+		text: yaml.MarshalStream(_resources)
+	}
+}
+
+// The ls command prints a table with the Kubernetes resources kind, namespace, name and version.
+// Example 'cue cmd -t debug -t name=test -t namespace=test -t mv=1.0.0 -t kv=1.28.0 ls'.
+command: ls: {
+	task: print: cli.Print & {
+		text: tabwriter.Write([
+			"RESOURCE \tAPI VERSION",
+			for r in _resources {
+				if r.metadata.namespace == _|_ {
+					"\(r.kind)/\(r.metadata.name) \t\(r.apiVersion)"
+				}
+				if r.metadata.namespace != _|_ {
+					"\(r.kind)/\(r.metadata.namespace)/\(r.metadata.name)  \t\(r.apiVersion)"
+				}
+			},
+		])
+	}
+}
+`
+
+	return m.Container().
+		WithExec([]string{"timoni", "mod", "init", name}).
+		WithWorkdir(name).
+		// the starter templates, their values and their tests are replaced by the scaffold
+		WithExec([]string{"sh", "-c", "rm -rf templates/*.cue test values.cue debug_values.cue debug_tool.cue timoni.cue"}).
+		WithDirectory(path.Join("cue.mod/gen", modulePath), source, dagger.ContainerWithDirectoryOpts{
+			Exclude: []string{"cue.mod"},
+		}).
+		WithNewFile("templates/config.cue", config).
+		WithNewFile(fmt.Sprintf("templates/%s.cue", strings.ToLower(kind)), template).
+		WithNewFile("values.cue", values).
+		WithNewFile("debug_values.cue", debugValues).
+		WithNewFile("debug_tool.cue", debugTool).
+		WithNewFile("timoni.cue", timoni).
+		WithExec([]string{"cue", "fmt", "./..."}).
+		// timoni mod vet needs concrete values, which the required fields of the spec don't have yet
+		WithExec([]string{"cue", "vet", "./..."}).
+		Directory("."), nil
+}
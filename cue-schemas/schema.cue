@@ -11,13 +11,34 @@ package schema
 	files: [...string]
 	dirs: [...string]
 	assets: [...string]
+	// import ObjectMeta from this k8s.io module version
+	kubernetes?: #Semver
 }
 
 #KubernetesSource: {
 	version: #Semver
+	// only vendor these API groups, e.g. "core/v1" or "networking.k8s.io"
+	include: [...string]
+	// leave out these API groups
+	exclude: [...string]
+}
+
+#TimoniSource: {
+	version: #Semver
+}
+
+#OpenapiSource: {
+	// the module path, e.g. example.com/api
+	module:  =~#"^[\w\.-]+(/[\w\.-]+)*$"#
+	version: #Semver
+	// the URL of an OpenAPI v3 document
+	url: string
 }
 
 #Schema: {
 	github: [...#GithubSource]
 	kubernetes: [...#KubernetesSource]
+	// the timoni versions to vendor timoni.sh schemas for, the module's timoni version if empty
+	timoni: [...#TimoniSource]
+	openapi: [...#OpenapiSource]
 }
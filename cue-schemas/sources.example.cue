@@ -0,0 +1,21 @@
+package sources
+
+github: [
+	{
+		tag:   "v2.4.0"
+		owner: "fluxcd"
+		repo:  "flux2"
+		assets: ["install.yaml"]
+	},
+	{
+		tag:   "v1.2.6"
+		owner: "envoyproxy"
+		repo:  "gateway"
+		files: ["charts/gateway-helm/crds/gatewayapi-crds.yaml"]
+		dirs: ["charts/gateway-helm/crds/generated"]
+	},
+]
+
+kubernetes: [for v in ["v1.31.4", "v1.32.0"] {version: v}]
+
+timoni: [for v in ["v0.22.1", "v0.23.0"] {version: v}]
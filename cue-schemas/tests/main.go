@@ -0,0 +1,117 @@
+// Integration tests for the cue-schemas module
+
+package main
+
+import (
+	"context"
+	"dagger/tests/internal/dagger"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type Tests struct{}
+
+// returns a fake GitHub serving the contents API, raw files and release assets from testdata
+func (m *Tests) FakeGithub(
+	// +optional
+	// +defaultPath="testdata/fakegithub"
+	src *dagger.Directory,
+) *dagger.Service {
+	return dag.Container().
+		From("golang").
+		WithDirectory("/src", src).
+		WithWorkdir("/src").
+		WithExposedPort(8080).
+		AsService(dagger.ContainerAsServiceOpts{Args: []string{"go", "run", "main.go", "-addr", ":8080"}})
+}
+
+// run Validate, Vendor, Export and Publish end to end against a fake GitHub and a local registry
+func (m *Tests) Integration(
+	ctx context.Context,
+	// +optional
+	// +defaultPath="testdata"
+	testdata *dagger.Directory,
+) (string, error) {
+	github, err := m.FakeGithub(testdata.Directory("fakegithub")).Start(ctx)
+	if err != nil {
+		return "", err
+	}
+	endpoint, err := github.Endpoint(ctx, dagger.ServiceEndpointOpts{Scheme: "http"})
+	if err != nil {
+		return "", err
+	}
+	schemas := dag.CueSchemas(dagger.CueSchemasOpts{
+		GithubAPI:      endpoint + "/api",
+		GithubRaw:      endpoint + "/raw",
+		GithubDownload: endpoint + "/download",
+		GithubService:  github,
+	})
+	timoniVersion, err := schemas.TimoniVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	file := testdata.File("sources.yaml")
+	expected := []string{
+		"gadgets.acme.example-v1.0.0",
+		"sprockets.acme.example-v1.0.0",
+		"widgets.acme.example-v1.0.0",
+		"timoni.sh-" + timoniVersion,
+	}
+	var result string
+
+	if err := schemas.Validate(ctx, file); err != nil {
+		return result, fmt.Errorf("validate: %w", err)
+	}
+	result += "ok validate\n"
+
+	entries, err := schemas.Vendor(file).Entries(ctx)
+	if err != nil {
+		return result, fmt.Errorf("vendor: %w", err)
+	}
+	for i, e := range entries {
+		entries[i] = strings.TrimSuffix(e, "/")
+	}
+	for _, e := range expected {
+		if !slices.Contains(entries, e) {
+			return result, fmt.Errorf("vendor: module %s not found in %s", e, strings.Join(entries, ", "))
+		}
+	}
+	result += fmt.Sprintf("ok vendor: %s\n", strings.Join(entries, ", "))
+
+	crds, err := schemas.Export(file).File("acme-widgets.cue").Contents(ctx)
+	if err != nil {
+		return result, fmt.Errorf("export: %w", err)
+	}
+	for _, name := range []string{"gadgets.gadgets.acme.example", "sprockets.sprockets.acme.example", "widgets.widgets.acme.example"} {
+		if !strings.Contains(crds, name) {
+			return result, fmt.Errorf("export: CRD %s not found in acme-widgets.cue", name)
+		}
+	}
+	result += "ok export\n"
+
+	registry := dag.Container().
+		From("registry:2").
+		WithExposedPort(5000).
+		AsService()
+	if _, err := schemas.Publish(ctx, file, dagger.CueSchemasPublishOpts{Service: registry}); err != nil {
+		return result, fmt.Errorf("publish: %w", err)
+	}
+	crane := dag.Container().
+		From("gcr.io/go-containerregistry/crane:debug").
+		WithServiceBinding("registry", registry)
+	for _, e := range expected {
+		i := strings.LastIndex(e, "-")
+		path, version := e[:i], e[i+1:]
+		tags, err := crane.WithExec([]string{"crane", "ls", "--insecure", fmt.Sprintf("registry:5000/%s", path)}).
+			Stdout(ctx)
+		if err != nil {
+			return result, fmt.Errorf("publish: %s: %w", path, err)
+		}
+		if !slices.Contains(strings.Fields(tags), version) {
+			return result, fmt.Errorf("publish: %s:%s not found in the registry", path, version)
+		}
+	}
+	result += fmt.Sprintf("ok publish: %d modules\n", len(expected))
+	return result, nil
+}
@@ -0,0 +1,80 @@
+// A fake GitHub serving canned contents API responses, raw files and release assets
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+type content struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	SHA         string `json:"sha"`
+	Size        int64  `json:"size"`
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+// returns the git blob SHA of a file
+func blobSHA(name string) (string, int64, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return "", 0, err
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(b))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), int64(len(b)), nil
+}
+
+func main() {
+	addr := flag.String("addr", ":8080", "the listen address")
+	repos := flag.String("repos", "repos", "the repository contents, as <owner>/<repo>/<ref>/<path>")
+	releases := flag.String("releases", "releases", "the release assets, as <owner>/<repo>/<tag>/<asset>")
+	flag.Parse()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/repos/{owner}/{repo}/contents/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		owner, repo, ref, p := r.PathValue("owner"), r.PathValue("repo"), r.URL.Query().Get("ref"), r.PathValue("path")
+		dir := filepath.Join(*repos, owner, repo, ref, filepath.FromSlash(p))
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+			return
+		}
+		contents := []content{}
+		for _, e := range entries {
+			c := content{Type: "dir", Name: e.Name(), Path: p + "/" + e.Name()}
+			if !e.IsDir() {
+				sha, size, err := blobSHA(filepath.Join(dir, e.Name()))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				c.Type, c.SHA, c.Size = "file", sha, size
+				c.DownloadURL = fmt.Sprintf("http://%s/raw/%s/%s/refs/tags/%s/%s", r.Host, owner, repo, ref, c.Path)
+			}
+			contents = append(contents, c)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(contents)
+	})
+	mux.HandleFunc("GET /raw/{owner}/{repo}/refs/tags/{ref}/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(*repos, r.PathValue("owner"), r.PathValue("repo"), r.PathValue("ref"),
+			filepath.FromSlash(r.PathValue("path"))))
+	})
+	mux.HandleFunc("GET /download/{owner}/{repo}/releases/download/{tag}/{asset}", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(*releases, r.PathValue("owner"), r.PathValue("repo"), r.PathValue("tag"),
+			r.PathValue("asset")))
+	})
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
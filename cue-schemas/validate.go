@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"dagger/cue-schemas/internal/dagger"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/ast/astutil"
+	"cuelang.org/go/cue/cuecontext"
+	"cuelang.org/go/cue/errors"
+	"cuelang.org/go/cue/parser"
+	"cuelang.org/go/cue/token"
+	"github.com/Masterminds/semver/v3"
+)
+
+// a problem found in a sources file
+type Diagnostic struct {
+	// the severity (error or warning)
+	Severity string
+	// the file the diagnostic refers to
+	File string
+	// the line in the sources file, 0 if unknown
+	Line int
+	// the column in the sources file, 0 if unknown
+	Column int
+	// the path of the offending value (e.g. github[1].tag)
+	Path string
+	// the index of the source in its section, -1 if unknown
+	Source int
+	// the human readable message
+	Message string
+}
+
+func (d *Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s: %s", d.File, d.Line, d.Column, d.Severity, d.Path, d.Message)
+}
+
+// returns the #Schema definition, closed unless allowUnknown is set
+func sourcesSchema(cctx *cue.Context, allowUnknown bool) (cue.Value, error) {
+	f, err := parser.ParseFile("schema.cue", schemaFile)
+	if err != nil {
+		return cue.Value{}, err
+	}
+	if allowUnknown {
+		astutil.Apply(f, func(c astutil.Cursor) bool {
+			if s, ok := c.Node().(*ast.StructLit); ok {
+				s.Elts = append(s.Elts, &ast.Ellipsis{})
+			}
+			return true
+		}, nil)
+	}
+	return cctx.BuildFile(f).LookupPath(cue.ParsePath("#Schema")), nil
+}
+
+// returns the position of a value in the sources file
+func position(v cue.Value) token.Pos {
+	// YAML sequence items have no file position, fall back to their first field
+	if pos := v.Pos(); pos.IsValid() && pos.Filename() != "" {
+		return pos
+	}
+	if iter, err := v.Fields(); err == nil && iter.Next() {
+		return iter.Value().Pos()
+	}
+	return token.NoPos
+}
+
+func newDiagnostic(severity string, name string, pos token.Pos, path []string, msg string) *Diagnostic {
+	d := &Diagnostic{
+		Severity: severity,
+		File:     name,
+		Source:   -1,
+		Message:  msg,
+	}
+	if pos.IsValid() {
+		d.Line, d.Column = pos.Line(), pos.Column()
+	}
+	if len(path) > 0 && strings.HasPrefix(path[0], "#") {
+		path = path[1:]
+	}
+	for i, p := range path {
+		if n, err := strconv.Atoi(p); err == nil {
+			d.Path += fmt.Sprintf("[%d]", n)
+			if i == 1 {
+				d.Source = n
+			}
+		} else if d.Path == "" {
+			d.Path = p
+		} else {
+			d.Path += "." + p
+		}
+	}
+	return d
+}
+
+// converts CUE errors to diagnostics, using the position in the sources file if available
+func errorDiagnostics(severity string, name string, err error) []*Diagnostic {
+	var diags []*Diagnostic
+	for _, e := range errors.Errors(err) {
+		var pos token.Pos
+		for _, p := range errors.Positions(e) {
+			if p.Filename() == name {
+				pos = p
+			}
+		}
+		format, args := e.Msg()
+		diags = append(diags, newDiagnostic(severity, name, pos, e.Path(), fmt.Sprintf(format, args...)))
+	}
+	return diags
+}
+
+// validates a sources file and decodes it if there are no errors
+func (m *CueSchemas) diagnose(ctx context.Context, file *dagger.File, allowUnknown bool) ([]*Diagnostic, *Sources, error) {
+	name, err := file.Name(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	cctx := cuecontext.New()
+	value, err := m.compileSources(ctx, cctx, file)
+	if err != nil {
+		var cerr errors.Error
+		if !errors.As(err, &cerr) {
+			return nil, nil, err
+		}
+		return errorDiagnostics("error", name, err), nil, nil
+	}
+	schema, err := sourcesSchema(cctx, allowUnknown)
+	if err != nil {
+		return nil, nil, err
+	}
+	diags := errorDiagnostics("error", name, schema.Unify(value).Validate(cue.Concrete(true)))
+	if allowUnknown {
+		closed, err := sourcesSchema(cctx, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, d := range errorDiagnostics("warning", name, closed.Unify(value).Validate()) {
+			if d.Message == "field not allowed" {
+				diags = append(diags, d)
+			}
+		}
+	}
+	for _, d := range diags {
+		if d.Severity == "error" {
+			return diags, nil, nil
+		}
+	}
+	var sources Sources
+	if err := schema.Unify(value).Decode(&sources); err != nil {
+		return nil, nil, err
+	}
+	// semantic checks the schema can't express
+	check := func(section string, i int, msg string) {
+		path := fmt.Sprintf("%s[%d]", section, i)
+		diags = append(diags, newDiagnostic("error", name, position(value.LookupPath(cue.ParsePath(path))),
+			[]string{section, strconv.Itoa(i)}, msg))
+	}
+	repos := map[string]int{}
+	for i, s := range sources.Github {
+		if len(s.Files)+len(s.Dirs)+len(s.Assets) == 0 {
+			check("github", i, "no files, dirs or assets to vendor")
+		}
+		key := fmt.Sprintf("%s/%s@%s", s.Owner, s.Repo, s.Tag)
+		if j, ok := repos[key]; ok {
+			check("github", i, fmt.Sprintf("%s is already vendored by github[%d]", key, j))
+		} else {
+			repos[key] = i
+		}
+	}
+	versions, minors := map[string]int{}, map[string]int{}
+	for i, s := range sources.Kubernetes {
+		if j, ok := versions[s.Version]; ok {
+			check("kubernetes", i, fmt.Sprintf("module directory k8s.io-%s is already produced by kubernetes[%d]", s.Version, j))
+			continue
+		}
+		versions[s.Version] = i
+		v, err := semver.NewVersion(s.Version)
+		if err != nil {
+			check("kubernetes", i, err.Error())
+			continue
+		}
+		minor := fmt.Sprintf("v%d.%d", v.Major(), v.Minor())
+		if j, ok := minors[minor]; ok {
+			check("kubernetes", i, fmt.Sprintf("Kubernetes minor %s is already vendored by kubernetes[%d]", minor, j))
+		} else {
+			minors[minor] = i
+		}
+	}
+	for i, s := range sources.Github {
+		if _, ok := versions[s.Kubernetes]; s.Kubernetes != "" && !ok {
+			warn := newDiagnostic("warning", name, position(value.LookupPath(cue.ParsePath(fmt.Sprintf("github[%d].kubernetes", i)))),
+				[]string{"github", strconv.Itoa(i), "kubernetes"}, fmt.Sprintf("k8s.io@%s is not vendored by a kubernetes source and must already be published", s.Kubernetes))
+			diags = append(diags, warn)
+		}
+	}
+	timoni := map[string]int{}
+	for i, s := range sources.Timoni {
+		if j, ok := timoni[s.Version]; ok {
+			check("timoni", i, fmt.Sprintf("module directory timoni.sh-%s is already produced by timoni[%d]", s.Version, j))
+		} else {
+			timoni[s.Version] = i
+		}
+	}
+	openapi := map[string]int{}
+	for i, s := range sources.Openapi {
+		key := moduleDir(s.Module, s.Version)
+		if j, ok := openapi[key]; ok {
+			check("openapi", i, fmt.Sprintf("module directory %s is already produced by openapi[%d]", key, j))
+		} else {
+			openapi[key] = i
+		}
+	}
+	for _, d := range diags {
+		if d.Severity == "error" {
+			return diags, nil, nil
+		}
+	}
+	return diags, &sources, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"dagger/talos/internal/dagger"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// manifests or a Helm release applied after bootstrap
+type Addon struct {
+	// +private
+	Manifests *dagger.Directory
+	// +private
+	Chart *dagger.Directory
+	// +private
+	Values *dagger.File
+	// +private
+	Name string
+	// +private
+	Namespace string
+}
+
+var chartNameRegexp = regexp.MustCompile(`(?m)^name:\s*["']?([^"'\s]+)`)
+
+// applies the manifests after bootstrap, CRDs first, then namespaces, then the rest
+func (t *Talos) WithManifests(
+	// a directory of YAML or JSON manifests, or a kustomization
+	dir *dagger.Directory,
+) *Talos {
+	t.Addons = append(t.Addons, Addon{Manifests: dir})
+	return t
+}
+
+// installs a Helm chart after bootstrap
+func (t *Talos) WithHelmRelease(
+	// the chart directory
+	chart *dagger.Directory,
+	// +optional
+	// the values file
+	values *dagger.File,
+	// +optional
+	// +default="default"
+	// the release namespace
+	namespace string,
+	// +optional
+	// the release name, the chart name if empty
+	name string,
+) *Talos {
+	t.Addons = append(t.Addons, Addon{Chart: chart, Values: values, Name: name, Namespace: namespace})
+	return t
+}
+
+// renders a manifests directory, building it with kustomize if it contains a kustomization
+func (t *Talos) renderManifests(ctx context.Context, dir *dagger.Directory) (string, error) {
+	entries, err := dir.Entries(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if e == "kustomization.yaml" || e == "kustomization.yml" || e == "Kustomization" {
+			return dag.Container().
+				WithFile("/bin/kubectl", t.kubectl()).
+				WithDirectory("/manifests", dir).
+				WithExec([]string{"kubectl", "kustomize", "/manifests"}).
+				Stdout(ctx)
+		}
+	}
+	var files []string
+	for _, pattern := range []string{"**/*.yaml", "**/*.yml", "**/*.json"} {
+		matches, err := dir.Glob(ctx, pattern)
+		if err != nil {
+			return "", err
+		}
+		files = append(files, matches...)
+	}
+	slices.Sort(files)
+	var docs []string
+	for _, f := range files {
+		contents, err := dir.File(f).Contents(ctx)
+		if err != nil {
+			return "", err
+		}
+		docs = append(docs, contents)
+	}
+	return strings.Join(docs, "\n---\n"), nil
+}
+
+// a workload to wait for the rollout of
+type workload struct {
+	kind      string
+	name      string
+	namespace string
+}
+
+// splits manifests into CRDs, namespaces and the remaining resources, and returns the workloads among them
+func orderManifests(manifests string) ([]string, []workload, error) {
+	var groups [3]bytes.Buffer
+	var encoders [3]*yaml.Encoder
+	for i := range groups {
+		encoders[i] = yaml.NewEncoder(&groups[i])
+		encoders[i].SetIndent(2)
+	}
+	var workloads []workload
+	dec := yaml.NewDecoder(strings.NewReader(manifests))
+	for {
+		var doc map[string]any
+		if err := dec.Decode(&doc); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if doc == nil {
+			continue
+		}
+		kind, _ := doc["kind"].(string)
+		group := 2
+		switch kind {
+		case "CustomResourceDefinition":
+			group = 0
+		case "Namespace":
+			group = 1
+		case "Deployment", "DaemonSet", "StatefulSet":
+			metadata, _ := doc["metadata"].(map[string]any)
+			name, _ := metadata["name"].(string)
+			namespace, _ := metadata["namespace"].(string)
+			if namespace == "" {
+				namespace = "default"
+			}
+			workloads = append(workloads, workload{kind: strings.ToLower(kind), name: name, namespace: namespace})
+		}
+		if err := encoders[group].Encode(doc); err != nil {
+			return nil, nil, err
+		}
+	}
+	var ordered []string
+	for i := range groups {
+		if err := encoders[i].Close(); err != nil {
+			return nil, nil, err
+		}
+		ordered = append(ordered, groups[i].String())
+	}
+	return ordered, workloads, nil
+}
+
+// applies the manifests and Helm releases and waits for their rollouts
+func (t *Talos) withAddons(ctx context.Context, ctr *dagger.Container, timeout string) (*dagger.Container, error) {
+	if len(t.Addons) == 0 {
+		return ctr, nil
+	}
+	ctr = ctr.WithFile("/bin/helm", dag.Container().
+		From("alpine/helm").
+		File("/usr/bin/helm"))
+	for i, a := range t.Addons {
+		dir := fmt.Sprintf("addons/%d", i)
+		if a.Chart != nil {
+			name := a.Name
+			if name == "" {
+				chart, err := a.Chart.File("Chart.yaml").Contents(ctx)
+				if err != nil {
+					return nil, err
+				}
+				match := chartNameRegexp.FindStringSubmatch(chart)
+				if match == nil {
+					return nil, fmt.Errorf("no chart name in %s/Chart.yaml", dir)
+				}
+				name = match[1]
+			}
+			args := []string{"helm", "upgrade", "--install", name, dir, "--namespace", a.Namespace, "--create-namespace",
+				"--wait", "--timeout", timeout}
+			ctr = ctr.WithDirectory(dir, a.Chart)
+			if a.Values != nil {
+				ctr = ctr.WithFile(dir+"-values.yaml", a.Values)
+				args = append(args, "--values", dir+"-values.yaml")
+			}
+			ctr = ctr.WithExec(args)
+			continue
+		}
+		manifests, err := t.renderManifests(ctx, a.Manifests)
+		if err != nil {
+			return nil, err
+		}
+		groups, workloads, err := orderManifests(manifests)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+		for j, name := range []string{"crds.yaml", "namespaces.yaml", "resources.yaml"} {
+			if groups[j] == "" {
+				continue
+			}
+			ctr = ctr.WithNewFile(fmt.Sprintf("%s/%s", dir, name), groups[j]).
+				WithExec([]string{"kubectl", "apply", "--server-side", "-f", fmt.Sprintf("%s/%s", dir, name)})
+			if j == 0 {
+				ctr = ctr.WithExec([]string{"kubectl", "wait", "--for=condition=Established", "-f", fmt.Sprintf("%s/%s", dir, name), fmt.Sprintf("--timeout=%s", timeout)})
+			}
+		}
+		for _, w := range workloads {
+			ctr = ctr.WithExec([]string{"kubectl", "rollout", "status", "-n", w.namespace, fmt.Sprintf("%s/%s", w.kind, w.name), fmt.Sprintf("--timeout=%s", timeout)})
+		}
+	}
+	return ctr, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"dagger/talos/internal/dagger"
+	"fmt"
+	"slices"
+)
+
+const (
+	calicoVersion = "v3.29.1"
+	ciliumVersion = "1.16.4"
+)
+
+var cnis = []string{"flannel", "none", "cilium", "calico"}
+
+// the DaemonSet running the CNI on every node
+var cniDaemonSets = map[string]string{
+	"calico": "calico-node",
+	"cilium": "cilium",
+}
+
+func validateCNI(cni string) error {
+	if !slices.Contains(cnis, cni) {
+		return fmt.Errorf("unknown CNI %q, expected one of %v", cni, cnis)
+	}
+	return nil
+}
+
+// returns the talosctl flags replacing the default flannel CNI
+func (t *Talos) cniFlags() []string {
+	if t.CNI == "flannel" || t.CNI == "" {
+		return nil
+	}
+	return []string{`--config-patch=[{"op": "add", "path": "/cluster/network/cni", "value": {"name": "none"}}]`}
+}
+
+// returns the bundled manifests for a CNI
+func cniManifests(cni string) *dagger.Directory {
+	switch cni {
+	case "calico":
+		return dag.Directory().
+			WithFile("calico.yaml", dag.HTTP(fmt.Sprintf("https://raw.githubusercontent.com/projectcalico/calico/%s/manifests/calico.yaml", calicoVersion)))
+	case "cilium":
+		// https://www.talos.dev/v1.8/kubernetes-guides/network/deploying-cilium/
+		return dag.Container().
+			From("alpine/helm").
+			WithDirectory("/cni", dag.Directory()).
+			WithExec([]string{"helm", "repo", "add", "cilium", "https://helm.cilium.io/"}).
+			WithExec([]string{"sh", "-c", fmt.Sprintf("helm template cilium cilium/cilium --version %s --namespace kube-system"+
+				" --set ipam.mode=kubernetes --set kubeProxyReplacement=false"+
+				" --set securityContext.capabilities.ciliumAgent='{CHOWN,KILL,NET_ADMIN,NET_RAW,IPC_LOCK,SYS_ADMIN,SYS_RESOURCE,DAC_OVERRIDE,FOWNER,SETGID,SETUID}'"+
+				" --set securityContext.capabilities.cleanCiliumState='{NET_ADMIN,SYS_ADMIN,SYS_RESOURCE}'"+
+				" --set cgroup.autoMount.enabled=false --set cgroup.hostRoot=/sys/fs/cgroup"+
+				" > /cni/cilium.yaml", ciliumVersion)}).
+			Directory("/cni")
+	}
+	return nil
+}
+
+// installs the CNI once the nodes are created and waits for it to roll out
+func (t *Talos) withCNI(ctr *dagger.Container, timeout string) *dagger.Container {
+	if t.CNI == "flannel" || t.CNI == "none" || t.CNI == "" {
+		return ctr
+	}
+	manifests := t.CNIManifests
+	if manifests == nil {
+		manifests = cniManifests(t.CNI)
+	}
+	var nodes []string
+	for _, n := range t.nodes() {
+		nodes = append(nodes, fmt.Sprintf("node/%s", n.Hostname))
+	}
+	return ctr.WithExec(waitForCreate(timeout, nodes...)).
+		WithDirectory("cni", manifests).
+		WithExec([]string{"kubectl", "apply", "--server-side", "--recursive", "-f", "cni"}).
+		WithExec([]string{"kubectl", "rollout", "status", "-n", "kube-system", fmt.Sprintf("daemonset/%s", cniDaemonSets[t.CNI]), fmt.Sprintf("--timeout=%s", timeout)})
+}
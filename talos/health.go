@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"dagger/talos/internal/dagger"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the result of a single health check
+type HealthCheck struct {
+	// the check name
+	Name string
+	// passed or failed
+	Status string
+	// how long the check took
+	Duration string
+	// the check output, or the reason it failed
+	Message string
+}
+
+// the results of the cluster health checks
+type HealthReport struct {
+	// whether every check passed
+	Healthy bool
+	// the individual checks
+	Checks []*HealthCheck
+}
+
+// fails with the failed checks if the cluster is not healthy
+func (r *HealthReport) Assert() error {
+	if r.Healthy {
+		return nil
+	}
+	var failed []string
+	for _, c := range r.Checks {
+		if c.Status != "passed" {
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, c.Message))
+		}
+	}
+	return fmt.Errorf("cluster is unhealthy:\n%s", strings.Join(failed, "\n"))
+}
+
+// returns the command waiting for the kube-system pods to be ready, the pods of completed jobs are left out
+func waitForSystemPods(timeout string) []string {
+	return []string{"kubectl", "wait", "--for=condition=Ready", "pods", "--all", "-n", "kube-system",
+		"--field-selector=status.phase!=Succeeded", fmt.Sprintf("--timeout=%s", timeout)}
+}
+
+// runs a command and records its result as a check
+func runCheck(ctx context.Context, ctr *dagger.Container, name string, args []string, verify func(stdout string) error) *HealthCheck {
+	start := time.Now()
+	ctr = ctr.WithEnvVariable("CACHEBUST", start.String()).
+		WithExec(args, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+	check := &HealthCheck{Name: name, Status: "failed"}
+	code, err := ctr.ExitCode(ctx)
+	check.Duration = time.Since(start).Round(time.Millisecond).String()
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	stdout, _ := ctr.Stdout(ctx)
+	if code != 0 {
+		stderr, _ := ctr.Stderr(ctx)
+		check.Message = strings.TrimSpace(stdout + "\n" + stderr)
+		return check
+	}
+	if verify != nil {
+		if err := verify(stdout); err != nil {
+			check.Message = err.Error()
+			return check
+		}
+	}
+	check.Status, check.Message = "passed", strings.TrimSpace(stdout)
+	return check
+}
+
+// checks the Talos and Kubernetes health of the cluster, the report is returned whether the checks passed or not,
+// call assert on it to fail when the cluster is unhealthy
+func (t *Talos) Health(
+	ctx context.Context,
+	// +optional
+	// +default="300s"
+	// how long each check waits for the cluster to become healthy
+	timeout string,
+) (*HealthReport, error) {
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, err
+	}
+	ctr := t.Container(ctx)
+	var nodes []string
+	for _, n := range t.nodes() {
+		nodes = append(nodes, fmt.Sprintf("node/%s", n.Hostname))
+	}
+	report := &HealthReport{
+		Checks: []*HealthCheck{
+			// the node addresses are discovered by the first controlplane node, --control-plane-nodes only takes IPs
+			runCheck(ctx, ctr, "talos",
+				[]string{"talosctl", "-n", t.Controlplanes[0].Hostname, "health", "--wait-timeout", d.String()}, nil),
+			runCheck(ctx, ctr, "nodes-ready",
+				append([]string{"kubectl", "wait", "--for=condition=Ready", fmt.Sprintf("--timeout=%s", timeout)}, nodes...), nil),
+			runCheck(ctx, ctr, "etcd-members",
+				[]string{"talosctl", "-n", t.Controlplanes[0].Hostname, "etcd", "members"},
+				func(stdout string) error {
+					// the output is a header followed by one line per member
+					lines := strings.Split(strings.TrimSpace(stdout), "\n")
+					if members := len(lines) - 1; members != len(t.Controlplanes) {
+						return fmt.Errorf("expected %d etcd members, got %d", len(t.Controlplanes), members)
+					}
+					return nil
+				}),
+			runCheck(ctx, ctr, "kube-system-pods", waitForSystemPods(timeout), nil),
+		},
+	}
+	report.Healthy = true
+	for _, c := range report.Checks {
+		if c.Status != "passed" {
+			report.Healthy = false
+		}
+	}
+	return report, nil
+}
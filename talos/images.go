@@ -0,0 +1,97 @@
+package main
+
+import (
+	"dagger/talos/internal/dagger"
+	"fmt"
+	"strings"
+)
+
+const (
+	registryImage = "registry:2.8.3"
+	craneImage    = "gcr.io/go-containerregistry/crane:v0.20.2"
+)
+
+// starts a registry:2 in the background and waits for it, for scripts filling its storage
+const registryServeScript = "registry serve /etc/docker/registry/config.yml >/dev/null 2>&1 &\n" +
+	"timeout 60 sh -c 'until wget -q -O /dev/null http://localhost:5000/v2/; do sleep 1; done'\n"
+
+// a container image loaded into the cluster registry
+type Image struct {
+	// +private
+	Container *dagger.Container
+	// +private
+	Ref string
+}
+
+// splits an image reference into its registry host, repository and tag
+func parseImageRef(ref string) (string, string, string, error) {
+	if strings.Contains(ref, "@") {
+		return "", "", "", fmt.Errorf("image %s: digests are not supported, use a tag", ref)
+	}
+	host, repo := "docker.io", ref
+	if first, rest, ok := strings.Cut(ref, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		host, repo = first, rest
+	}
+	tag := "latest"
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo, tag = repo[:i], repo[i+1:]
+	}
+	if repo == "" || tag == "" {
+		return "", "", "", fmt.Errorf("invalid image reference %s", ref)
+	}
+	if host == "docker.io" && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	return host, repo, tag, nil
+}
+
+// loads a container into the cluster as the image ref, without pushing it to its registry
+func (t *Talos) LoadImage(
+	// the container to load
+	container *dagger.Container,
+	// the image reference pods use (e.g. example.com/app:dev)
+	ref string,
+) (*Talos, error) {
+	if _, _, _, err := parseImageRef(ref); err != nil {
+		return nil, err
+	}
+	t.Images = append(t.Images, Image{Container: container, Ref: ref})
+	return t, nil
+}
+
+// returns the hostname of the registry serving the loaded images
+func (t *Talos) registryHostname() string {
+	return fmt.Sprintf("%s-registry", t.Name)
+}
+
+// returns the registry:2 storage directory with the loaded images
+func (t *Talos) registryStorage() *dagger.Directory {
+	ctr := dag.Container().
+		From(registryImage).
+		WithFile("/bin/crane", crane())
+	script := registryServeScript
+	for i, img := range t.Images {
+		_, repo, tag, _ := parseImageRef(img.Ref)
+		tarball := fmt.Sprintf("/images/%d.tar", i)
+		ctr = ctr.WithMountedFile(tarball, img.Container.AsTarball())
+		script += fmt.Sprintf("crane push --insecure %s localhost:5000/%s:%s\n", tarball, repo, tag)
+	}
+	return ctr.WithExec([]string{"sh", "-ec", script}).
+		Directory("/var/lib/registry")
+}
+
+// returns the registry serving the loaded images, which are part of its storage so every binding serves them
+func (t *Talos) registry() *dagger.Service {
+	return dag.Container().
+		From(registryImage).
+		WithDirectory("/var/lib/registry", t.registryStorage()).
+		WithExposedPort(5000).
+		AsService()
+}
+
+// returns the crane binary
+func crane() *dagger.File {
+	return dag.Container().
+		From(craneImage).
+		File("/ko-app/crane")
+}
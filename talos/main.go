@@ -7,11 +7,17 @@ import (
 	"dagger/talos/internal/dagger"
 	"fmt"
 	"regexp"
+	"slices"
+	"strings"
 )
 
 type TalosNode struct {
 	Hostname string
 	Version  string
+	// +private
+	ConfigPatch []string
+	// +private
+	ConfigPatchFile []*dagger.File
 }
 
 func NewNode(hostname string, version string) TalosNode {
@@ -22,10 +28,25 @@ func NewNode(hostname string, version string) TalosNode {
 }
 
 func (n *TalosNode) Service(withExposedAPI bool) *dagger.Service {
+	return n.service(withExposedAPI, nil)
+}
+
+// a service bound to every node
+type ServiceBinding struct {
+	// +private
+	Hostname string
+	// +private
+	Service *dagger.Service
+}
+
+func (n *TalosNode) service(withExposedAPI bool, bindings []ServiceBinding) *dagger.Service {
 	// https://www.talos.dev/v1.8/talos-guides/install/local-platforms/docker/#running-talos-in-docker-manually
 	ctr := dag.Container().
-		From(fmt.Sprintf("ghcr.io/siderolabs/talos:%s", n.Version)).
-		WithNewFile("/etc/hostname", n.Hostname).
+		From(fmt.Sprintf("ghcr.io/siderolabs/talos:%s", n.Version))
+	for _, b := range bindings {
+		ctr = ctr.WithServiceBinding(b.Hostname, b.Service)
+	}
+	ctr = ctr.WithNewFile("/etc/hostname", n.Hostname).
 		WithMountedCache("/run", dag.CacheVolume(fmt.Sprintf("%s-run", n.Hostname))).
 		WithMountedCache("/system", dag.CacheVolume(fmt.Sprintf("%s-system", n.Hostname))).
 		WithMountedTemp("/tmp").
@@ -54,6 +75,24 @@ type Talos struct {
 	// +private
 	Version string
 	// +private
+	KubernetesVersion string
+	// +private
+	SecretsBundle *dagger.Secret
+	// +private
+	CNI string
+	// +private
+	CNIManifests *dagger.Directory
+	// +private
+	Patches ConfigPatches
+	// +private
+	Addons []Addon
+	// +private
+	Images []Image
+	// +private
+	Mirrors []RegistryMirror
+	// +private
+	Cache *RegistryCache
+	// +private
 	Controlplanes []TalosNode
 	// +private
 	Workers []TalosNode
@@ -76,7 +115,28 @@ func New(
 	// +default=1
 	// the desired number of worker nodes
 	workers int,
-) *Talos {
+	// +optional
+	// the desired Kubernetes version (e.g. 1.30.6), the Talos default if empty
+	kubernetesVersion string,
+	// +optional
+	// the cluster secrets bundle (secrets.yaml), generated if not set
+	secrets *dagger.Secret,
+	// +optional
+	// +default="flannel"
+	// the CNI to install (flannel, none, cilium or calico)
+	cni string,
+	// +optional
+	// the CNI manifests to apply after bootstrap instead of the bundled ones
+	cniManifests *dagger.Directory,
+) (*Talos, error) {
+	if kubernetesVersion != "" {
+		if err := validateKubernetesVersion(version, kubernetesVersion); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateCNI(cni); err != nil {
+		return nil, err
+	}
 	cps, ws := make([]TalosNode, controlplanes), make([]TalosNode, workers)
 	for i := range controlplanes {
 		cps[i] = NewNode(fmt.Sprintf("%s-controlplane-%d", name, i+1), version)
@@ -85,19 +145,43 @@ func New(
 		ws[i] = NewNode(fmt.Sprintf("%s-worker-%d", name, i+1), version)
 	}
 	return &Talos{
-		Name:          name,
-		Version:       version,
-		Controlplanes: cps,
-		Workers:       ws,
-	}
+		Name:              name,
+		Version:           version,
+		KubernetesVersion: strings.TrimPrefix(kubernetesVersion, "v"),
+		SecretsBundle:     secrets,
+		CNI:               cni,
+		CNIManifests:      cniManifests,
+		Controlplanes:     cps,
+		Workers:           ws,
+	}, nil
+}
+
+// returns the controlplane and worker nodes
+func (t *Talos) nodes() []TalosNode {
+	return slices.Concat(t.Controlplanes, t.Workers)
 }
 
 func (t *Talos) talosctlContainer() *dagger.Container {
-	return dag.Container().
+	ctr := dag.Container().
 		WithFile("/bin/talosctl", dag.Container().
 			From(fmt.Sprintf("ghcr.io/siderolabs/talosctl:%s", t.Version)).
-			File("/talosctl")).
-		WithExec([]string{"talosctl", "gen", "secrets"})
+			File("/talosctl"))
+	if t.SecretsBundle != nil {
+		return ctr.WithMountedSecret("secrets.yaml", t.SecretsBundle)
+	}
+	return ctr.WithExec([]string{"talosctl", "gen", "secrets"})
+}
+
+// the cluster secrets bundle, pass it to --secrets to reconnect to the cluster later
+func (t *Talos) Secrets(ctx context.Context) (*dagger.Secret, error) {
+	if t.SecretsBundle != nil {
+		return t.SecretsBundle, nil
+	}
+	secrets, err := t.talosctlContainer().File("secrets.yaml").Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dag.SetSecret(fmt.Sprintf("%s-secrets", t.Name), secrets), nil
 }
 
 func (t *Talos) withTalosconfig(endpoint string, node string) *dagger.Container {
@@ -124,37 +208,168 @@ func (t *Talos) Talosconfig(
 		File("talosconfig")
 }
 
-func (t *Talos) withMachineConfig(
-	ctx context.Context,
-	// +optional
-	// +default="10.87.13.37"
-	// the desired cluster VIP
-	vip string,
+// adds machineconfig patches applied to a single node
+func (t *Talos) WithNodeConfigPatch(
+	// the hostname of the node (e.g. talos-worker-1)
+	hostname string,
 	// +optional
 	// +default=[]
-	// patch generated machineconfigs (applied to all node types)
+	// patch the node machineconfig
 	configPatch []string,
 	// +optional
 	// +default=[]
-	// patch generated machineconfigs (applied to all node types)
+	// patch the node machineconfig
 	configPatchFile []*dagger.File,
-) *dagger.Container {
+) (*Talos, error) {
+	for _, nodes := range [][]TalosNode{t.Controlplanes, t.Workers} {
+		for i := range nodes {
+			if nodes[i].Hostname == hostname {
+				nodes[i].ConfigPatch = append(nodes[i].ConfigPatch, configPatch...)
+				nodes[i].ConfigPatchFile = append(nodes[i].ConfigPatchFile, configPatchFile...)
+				return t, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no node with hostname %s", hostname)
+}
+
+// returns the talosctl flags for the patches, the patch files are expected in dir
+func configPatchFlags(ctx context.Context, flag string, dir string, configPatch []string, configPatchFile []*dagger.File) []string {
 	var flags []string
 	for _, p := range configPatch {
-		flags = append(flags, fmt.Sprintf("--config-patch=%s", p))
+		flags = append(flags, fmt.Sprintf("--%s=%s", flag, p))
 	}
 	for _, p := range configPatchFile {
 		n, _ := p.Name(ctx)
-		flags = append(flags, fmt.Sprintf("--config-patch=@patches/%s", n))
+		flags = append(flags, fmt.Sprintf("--%s=@%s/%s", flag, dir, n))
+	}
+	return flags
+}
+
+// machineconfig patches applied to all nodes, controlplane nodes and worker nodes
+type ConfigPatches struct {
+	// +private
+	ConfigPatch []string
+	// +private
+	ConfigPatchFile []*dagger.File
+	// +private
+	ControlplaneConfigPatch []string
+	// +private
+	ControlplaneConfigPatchFile []*dagger.File
+	// +private
+	WorkerConfigPatch []string
+	// +private
+	WorkerConfigPatchFile []*dagger.File
+}
+
+// returns the patches followed by the other patches
+func (p ConfigPatches) with(other ConfigPatches) ConfigPatches {
+	return ConfigPatches{
+		ConfigPatch:                 slices.Concat(p.ConfigPatch, other.ConfigPatch),
+		ConfigPatchFile:             slices.Concat(p.ConfigPatchFile, other.ConfigPatchFile),
+		ControlplaneConfigPatch:     slices.Concat(p.ControlplaneConfigPatch, other.ControlplaneConfigPatch),
+		ControlplaneConfigPatchFile: slices.Concat(p.ControlplaneConfigPatchFile, other.ControlplaneConfigPatchFile),
+		WorkerConfigPatch:           slices.Concat(p.WorkerConfigPatch, other.WorkerConfigPatch),
+		WorkerConfigPatchFile:       slices.Concat(p.WorkerConfigPatchFile, other.WorkerConfigPatchFile),
+	}
+}
+
+// adds machineconfig patches applied whenever the cluster is bootstrapped
+func (t *Talos) WithConfigPatch(
+	// +optional
+	// +default=[]
+	// patch generated machineconfigs (applied to all node types)
+	configPatch []string,
+	// +optional
+	// +default=[]
+	// patch generated machineconfigs (applied to all node types)
+	configPatchFile []*dagger.File,
+	// +optional
+	// +default=[]
+	// patch generated machineconfigs (applied to controlplane nodes)
+	controlplaneConfigPatch []string,
+	// +optional
+	// +default=[]
+	// patch generated machineconfigs (applied to controlplane nodes)
+	controlplaneConfigPatchFile []*dagger.File,
+	// +optional
+	// +default=[]
+	// patch generated machineconfigs (applied to worker nodes)
+	workerConfigPatch []string,
+	// +optional
+	// +default=[]
+	// patch generated machineconfigs (applied to worker nodes)
+	workerConfigPatchFile []*dagger.File,
+) *Talos {
+	t.Patches = t.Patches.with(ConfigPatches{
+		ConfigPatch:                 configPatch,
+		ConfigPatchFile:             configPatchFile,
+		ControlplaneConfigPatch:     controlplaneConfigPatch,
+		ControlplaneConfigPatchFile: controlplaneConfigPatchFile,
+		WorkerConfigPatch:           workerConfigPatch,
+		WorkerConfigPatchFile:       workerConfigPatchFile,
+	})
+	return t
+}
+
+func (t *Talos) withMachineConfig(
+	ctx context.Context,
+	// the desired cluster VIP
+	vip string,
+	// the patches applied to the generated machineconfigs
+	patches ConfigPatches,
+) (*dagger.Container, error) {
+	flags := configPatchFlags(ctx, "config-patch", "patches", patches.ConfigPatch, patches.ConfigPatchFile)
+	flags = append(flags, configPatchFlags(ctx, "config-patch-control-plane", "patches-controlplane", patches.ControlplaneConfigPatch, patches.ControlplaneConfigPatchFile)...)
+	flags = append(flags, configPatchFlags(ctx, "config-patch-worker", "patches-worker", patches.WorkerConfigPatch, patches.WorkerConfigPatchFile)...)
+	if t.KubernetesVersion != "" {
+		flags = append(flags, fmt.Sprintf("--kubernetes-version=%s", t.KubernetesVersion))
 	}
+	flags = append(flags, t.cniFlags()...)
 	return t.withTalosconfig(vip, t.Controlplanes[0].Hostname).
-		WithFiles("patches", configPatchFile).
+		WithFiles("patches", patches.ConfigPatchFile).
+		WithFiles("patches-controlplane", patches.ControlplaneConfigPatchFile).
+		WithFiles("patches-worker", patches.WorkerConfigPatchFile).
 		WithExec(append([]string{"talosctl", "gen", "config", t.Name, fmt.Sprintf("https://%s:6443", vip), fmt.Sprintf("--additional-sans=localhost,talos"),
 			fmt.Sprintf("--config-patch-control-plane=[{\"op\": \"add\", \"path\": \"/machine/network/interfaces\", \"value\": [{\"interface\": \"eth1\", \"dhcp\": true, \"vip\": {\"ip\": \"%s\"}}]}]", vip),
-			"--with-secrets=secrets.yaml", "--with-docs=false", "--with-examples=false", "--output-types=controlplane,worker"}, flags...))
+			"--with-secrets=secrets.yaml", "--with-docs=false", "--with-examples=false", "--output-types=controlplane,worker"}, flags...)), nil
+}
+
+// binds the node and applies the machineconfig with its hostname and node patches
+func (t *Talos) withNode(ctx context.Context, ctr *dagger.Container, n TalosNode, config string, extraFlags []string) *dagger.Container {
+	dir := fmt.Sprintf("patches-%s", n.Hostname)
+	flags := append([]string{fmt.Sprintf("--config-patch=[{\"op\": \"add\", \"path\": \"/machine/network/hostname\", \"value\": \"%s\"}]", n.Hostname)},
+		configPatchFlags(ctx, "config-patch", dir, n.ConfigPatch, n.ConfigPatchFile)...)
+	flags = append(flags, extraFlags...)
+	return ctr.WithServiceBinding(n.Hostname, t.nodeService(n, false)).
+		WithFiles(dir, n.ConfigPatchFile).
+		WithExec(append([]string{"talosctl", "--talosconfig", "talosconfig", "-n", n.Hostname, "apply", "--insecure", "-f", config}, flags...))
 }
 
-// bootstraps the etcd cluster and waits for first controlplane node to register
+// waits for every node according to the readiness policy
+func (t *Talos) withReadiness(ctr *dagger.Container, readiness string, timeout string) (*dagger.Container, error) {
+	var nodes []string
+	for _, n := range t.nodes() {
+		nodes = append(nodes, fmt.Sprintf("node/%s", n.Hostname))
+	}
+	wait := func(args ...string) []string {
+		return append([]string{"kubectl", "wait", fmt.Sprintf("--timeout=%s", timeout)}, args...)
+	}
+	switch readiness {
+	case "created":
+		return ctr.WithExec(waitForCreate(timeout, nodes...)), nil
+	case "ready":
+		return ctr.WithExec(waitForCreate(timeout, nodes...)).
+			WithExec(wait(append([]string{"--for=condition=Ready"}, nodes...)...)), nil
+	case "ready-system-pods":
+		return ctr.WithExec(waitForCreate(timeout, nodes...)).
+			WithExec(wait(append([]string{"--for=condition=Ready"}, nodes...)...)).
+			WithExec(waitForSystemPods(timeout)), nil
+	}
+	return nil, fmt.Errorf("unknown readiness policy %q, expected created, ready or ready-system-pods", readiness)
+}
+
+// bootstraps the etcd cluster and waits for the nodes according to the readiness policy
 func (t *Talos) Bootstrap(
 	ctx context.Context,
 	// +optional
@@ -169,29 +384,136 @@ func (t *Talos) Bootstrap(
 	// +default=[]
 	// patch generated machineconfigs (applied to all node types)
 	configPatchFile []*dagger.File,
-) *dagger.Container {
-	ctr := t.withMachineConfig(ctx, vip, configPatch, configPatchFile).
+	// +optional
+	// +default=[]
+	// patch generated machineconfigs (applied to controlplane nodes)
+	controlplaneConfigPatch []string,
+	// +optional
+	// +default=[]
+	// patch generated machineconfigs (applied to controlplane nodes)
+	controlplaneConfigPatchFile []*dagger.File,
+	// +optional
+	// +default=[]
+	// patch generated machineconfigs (applied to worker nodes)
+	workerConfigPatch []string,
+	// +optional
+	// +default=[]
+	// patch generated machineconfigs (applied to worker nodes)
+	workerConfigPatchFile []*dagger.File,
+	// +optional
+	// +default="created"
+	// wait for the nodes to be created, ready, or ready with running kube-system pods (created, ready or ready-system-pods)
+	readiness string,
+	// +optional
+	// +default="300s"
+	// how long to wait for the Kubernetes API
+	apiTimeout string,
+	// +optional
+	// +default="300s"
+	// how long to wait for the nodes and pods according to the readiness policy
+	readyTimeout string,
+) (*dagger.Container, error) {
+	return t.bootstrap(ctx, bootstrapOptions{
+		VIP: vip,
+		Patches: t.Patches.with(ConfigPatches{
+			ConfigPatch:                 configPatch,
+			ConfigPatchFile:             configPatchFile,
+			ControlplaneConfigPatch:     controlplaneConfigPatch,
+			ControlplaneConfigPatchFile: controlplaneConfigPatchFile,
+			WorkerConfigPatch:           workerConfigPatch,
+			WorkerConfigPatchFile:       workerConfigPatchFile,
+		}),
+		Readiness:    readiness,
+		APITimeout:   apiTimeout,
+		ReadyTimeout: readyTimeout,
+	})
+}
+
+// the options shared by Bootstrap and UpgradeKubernetes
+type bootstrapOptions struct {
+	VIP          string
+	Patches      ConfigPatches
+	Readiness    string
+	APITimeout   string
+	ReadyTimeout string
+}
+
+// applies the machineconfigs, bootstraps etcd, waits for the nodes and applies the CNI and addons
+func (t *Talos) bootstrap(ctx context.Context, opts bootstrapOptions) (*dagger.Container, error) {
+	ctr, err := t.withMachineConfig(ctx, opts.VIP, opts.Patches)
+	if err != nil {
+		return nil, err
+	}
+	ctr = ctr.
 		WithFile("/bin/wait4x", dag.Container().
 			From("atkrad/wait4x").
 			File("/usr/bin/wait4x")).
-		WithFile("/bin/kubectl", dag.Container().
-			From("bitnami/kubectl").
-			File("/opt/bitnami/kubectl/bin/kubectl"))
+		WithFile("/bin/kubectl", t.kubectl())
+	// the registries patch is applied in memory by talosctl apply so its credentials never reach a file
+	ctr, registryFlags, err := t.withRegistries(ctx, ctr)
+	if err != nil {
+		return nil, err
+	}
 	for _, n := range t.Controlplanes {
-		ctr = ctr.WithServiceBinding(n.Hostname, n.Service(false)).
-			WithExec([]string{"talosctl", "--talosconfig", "talosconfig", "-n", n.Hostname, "apply", "--insecure", "-f", "controlplane.yaml",
-				fmt.Sprintf("--config-patch=[{\"op\": \"add\", \"path\": \"/machine/network/hostname\", \"value\": \"%s\"}]", n.Hostname)})
+		ctr = t.withNode(ctx, ctr, n, "controlplane.yaml", registryFlags)
 	}
 	for _, n := range t.Workers {
-		ctr = ctr.WithServiceBinding(n.Hostname, n.Service(false)).
-			WithExec([]string{"talosctl", "--talosconfig", "talosconfig", "-n", n.Hostname, "apply", "--insecure", "-f", "worker.yaml",
-				fmt.Sprintf("--config-patch=[{\"op\": \"add\", \"path\": \"/machine/network/hostname\", \"value\": \"%s\"}]", n.Hostname)})
+		ctr = t.withNode(ctx, ctr, n, "worker.yaml", registryFlags)
 	}
-	return ctr.WithExec([]string{"talosctl", "-e", t.Controlplanes[0].Hostname, "-n", t.Controlplanes[0].Hostname, "bootstrap"}).
-		WithExec([]string{"wait4x", "tcp", fmt.Sprintf("%s:6443", vip), "--timeout", "300s"}).
+	ctr = ctr.WithExec([]string{"talosctl", "-e", t.Controlplanes[0].Hostname, "-n", t.Controlplanes[0].Hostname, "bootstrap"}).
+		WithExec([]string{"wait4x", "tcp", fmt.Sprintf("%s:6443", opts.VIP), "--timeout", opts.APITimeout}).
 		WithExec([]string{"talosctl", "-n", t.Controlplanes[0].Hostname, "kubeconfig", "kubeconfig"}).
-		WithEnvVariable("KUBECONFIG", "kubeconfig").
-		WithExec([]string{"kubectl", "wait", "--for=create", fmt.Sprintf("node/%s", t.Controlplanes[0].Hostname), "--timeout=300s"})
+		WithEnvVariable("KUBECONFIG", "kubeconfig")
+	ctr, err = t.withReadiness(t.withCNI(ctr, opts.ReadyTimeout), opts.Readiness, opts.ReadyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return t.withAddons(ctx, ctr, opts.ReadyTimeout)
+}
+
+// bootstraps the cluster with the patches added by with-config-patch, upgrades Kubernetes through the first controlplane node
+// and waits for every node to run the new kubelet
+func (t *Talos) UpgradeKubernetes(
+	ctx context.Context,
+	// the Kubernetes version to upgrade to (e.g. 1.31.2)
+	to string,
+	// +optional
+	// +default="10.87.13.37"
+	// the desired cluster VIP
+	vip string,
+	// +optional
+	// +default="ready"
+	// wait for the nodes to be created, ready, or ready with running kube-system pods before upgrading (created, ready or ready-system-pods)
+	readiness string,
+	// +optional
+	// +default="300s"
+	// how long to wait for the Kubernetes API
+	apiTimeout string,
+	// +optional
+	// +default="600s"
+	// how long to wait for the nodes before the upgrade and for the new kubelet after it
+	timeout string,
+) (*dagger.Container, error) {
+	if err := validateKubernetesVersion(t.Version, to); err != nil {
+		return nil, err
+	}
+	to = strings.TrimPrefix(to, "v")
+	wait := []string{"kubectl", "wait", fmt.Sprintf("--for=jsonpath={.status.nodeInfo.kubeletVersion}=v%s", to), fmt.Sprintf("--timeout=%s", timeout)}
+	for _, n := range t.nodes() {
+		wait = append(wait, fmt.Sprintf("node/%s", n.Hostname))
+	}
+	ctr, err := t.bootstrap(ctx, bootstrapOptions{
+		VIP:          vip,
+		Patches:      t.Patches,
+		Readiness:    readiness,
+		APITimeout:   apiTimeout,
+		ReadyTimeout: timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ctr.WithExec([]string{"talosctl", "-e", t.Controlplanes[0].Hostname, "-n", t.Controlplanes[0].Hostname, "upgrade-k8s", "--to", to}).
+		WithExec(wait), nil
 }
 
 // returns a proxy service for the Talos controlplane
@@ -257,10 +579,10 @@ static_resources:
 		From("envoyproxy/envoy:v1.32.1").
 		WithNewFile("config.yaml", cfg)
 	for _, n := range t.Controlplanes {
-		ctr = ctr.WithServiceBinding(n.Hostname, n.Service(true))
+		ctr = ctr.WithServiceBinding(n.Hostname, t.nodeService(n, true))
 	}
 	for _, n := range t.Workers {
-		ctr = ctr.WithServiceBinding(n.Hostname, n.Service(false))
+		ctr = ctr.WithServiceBinding(n.Hostname, t.nodeService(n, false))
 	}
 	return ctr.WithExec([]string{"envoy", "-c", "config.yaml"}).
 		WithExposedPort(6443).
@@ -294,7 +616,5 @@ func (t *Talos) Kubeconfig(
 // returns a container that can execute talosctl and kubectl commands
 func (t *Talos) Container(ctx context.Context) *dagger.Container {
 	return t.withKubeconfig(ctx, "https://talos:6443").
-		WithFile("/bin/kubectl", dag.Container().
-			From("bitnami/kubectl").
-			File("/opt/bitnami/kubectl/bin/kubectl"))
+		WithFile("/bin/kubectl", t.kubectl())
 }
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"dagger/talos/internal/dagger"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// a registry mirror configured on every node
+type RegistryMirror struct {
+	// +private
+	Host string
+	// +private
+	Endpoints []string
+	// +private
+	Username string
+	// +private
+	Password *dagger.Secret
+	// +private
+	CA *dagger.File
+	// +private
+	InsecureSkipVerify bool
+	// +private
+	Service *dagger.Service
+}
+
+// a pre-seeded registry serving images to every node
+type RegistryCache struct {
+	// +private
+	Dir *dagger.Directory
+	// +private
+	Hosts []string
+}
+
+// mirrors a registry on every node, optionally through a pull-through cache service bound to the nodes
+func (t *Talos) WithRegistryMirror(
+	// the mirrored registry (e.g. docker.io)
+	host string,
+	// +optional
+	// +default=[]
+	// the mirror endpoints (e.g. https://mirror.example.com)
+	endpoint []string,
+	// +optional
+	// the pull-through cache service, reached as http://<cluster>-mirror-<n>:<port>
+	service *dagger.Service,
+	// +optional
+	// +default=5000
+	// the port of the pull-through cache service
+	port int,
+	// +optional
+	// the username for the mirror endpoints
+	username string,
+	// +optional
+	// the password for the mirror endpoints
+	password *dagger.Secret,
+	// +optional
+	// the CA certificate of the mirror endpoints
+	ca *dagger.File,
+	// +optional
+	// skip TLS verification of the mirror endpoints
+	insecureSkipVerify bool,
+) (*Talos, error) {
+	if service != nil {
+		endpoint = append(endpoint, fmt.Sprintf("http://%s-mirror-%d:%d", t.Name, len(t.Mirrors)+1, port))
+	}
+	if len(endpoint) == 0 {
+		return nil, fmt.Errorf("one of endpoint or service is required")
+	}
+	for _, e := range endpoint {
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %s: %w", e, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("endpoint %s: expected http(s)://<host>[:<port>]", e)
+		}
+	}
+	if username != "" && password == nil {
+		return nil, fmt.Errorf("username %s requires a password", username)
+	}
+	t.Mirrors = append(t.Mirrors, RegistryMirror{
+		Host:               host,
+		Endpoints:          endpoint,
+		Username:           username,
+		Password:           password,
+		CA:                 ca,
+		InsecureSkipVerify: insecureSkipVerify,
+		Service:            service,
+	})
+	return t, nil
+}
+
+// serves the images in a pre-seeded registry directory to every node, e.g. to bootstrap offline
+func (t *Talos) WithImageCache(
+	// the registry:2 storage directory, e.g. from image-cache
+	dir *dagger.Directory,
+	// +optional
+	// +default=["docker.io","ghcr.io","registry.k8s.io","gcr.io","quay.io"]
+	// the registries the cache mirrors
+	host []string,
+) *Talos {
+	t.Cache = &RegistryCache{Dir: dir, Hosts: host}
+	return t
+}
+
+var imageRegexp = regexp.MustCompile(`(?m)^\s*(?:-\s+)?image:\s*["']?([^"'\s]+)`)
+
+// returns the images the rendered manifests reference
+func manifestImages(manifests string) []string {
+	var images []string
+	for _, match := range imageRegexp.FindAllStringSubmatch(manifests, -1) {
+		images = append(images, match[1])
+	}
+	return images
+}
+
+// returns the images of the addons, rendering Helm charts with helm template
+func (t *Talos) addonImages(ctx context.Context) ([]string, error) {
+	var images []string
+	for i, a := range t.Addons {
+		dir := fmt.Sprintf("addons/%d", i)
+		var manifests string
+		var err error
+		if a.Chart != nil {
+			args := []string{"helm", "template", dir, "--namespace", a.Namespace}
+			ctr := dag.Container().
+				From("alpine/helm").
+				WithDirectory(dir, a.Chart)
+			if a.Values != nil {
+				ctr = ctr.WithFile(dir+"-values.yaml", a.Values)
+				args = append(args, "--values", dir+"-values.yaml")
+			}
+			manifests, err = ctr.WithExec(args).Stdout(ctx)
+		} else {
+			manifests, err = t.renderManifests(ctx, a.Manifests)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+		images = append(images, manifestImages(manifests)...)
+	}
+	return images, nil
+}
+
+// returns the images of the cluster: the Talos defaults for the Kubernetes version of the cluster, the CNI and the addons
+func (t *Talos) defaultImages(ctx context.Context) ([]string, error) {
+	stdout, err := t.talosctlContainer().
+		WithExec([]string{"talosctl", "image", "default"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	flannel := t.CNI == "flannel" || t.CNI == ""
+	var images []string
+	for _, img := range strings.Fields(stdout) {
+		ref, _, _ := strings.Cut(img, "@")
+		host, repo, _, err := parseImageRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		if !flannel && path.Base(repo) == "flannel" {
+			continue
+		}
+		if t.KubernetesVersion != "" && ((host == "registry.k8s.io" && strings.HasPrefix(repo, "kube-")) || (host == "ghcr.io" && repo == "siderolabs/kubelet")) {
+			img = fmt.Sprintf("%s/%s:v%s", host, repo, t.KubernetesVersion)
+		}
+		images = append(images, img)
+	}
+	if !flannel && t.CNI != "none" {
+		manifests := t.CNIManifests
+		if manifests == nil {
+			manifests = cniManifests(t.CNI)
+		}
+		rendered, err := t.renderManifests(ctx, manifests)
+		if err != nil {
+			return nil, fmt.Errorf("cni: %w", err)
+		}
+		images = append(images, manifestImages(rendered)...)
+	}
+	addons, err := t.addonImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var unique []string
+	for _, img := range append(images, addons...) {
+		if !slices.Contains(unique, img) {
+			unique = append(unique, img)
+		}
+	}
+	return unique, nil
+}
+
+// returns a registry:2 storage directory with the images, for WithImageCache
+func (t *Talos) ImageCache(
+	ctx context.Context,
+	// +optional
+	// +default=[]
+	// the images to cache, the images of Talos, the CNI and the addons of the cluster if empty
+	image []string,
+) (*dagger.Directory, error) {
+	if len(image) == 0 {
+		var err error
+		if image, err = t.defaultImages(ctx); err != nil {
+			return nil, err
+		}
+	}
+	script := registryServeScript
+	for _, img := range image {
+		// images pinned by digest are pulled by digest from the cache, crane copy keeps the digest
+		ref, _, _ := strings.Cut(img, "@")
+		_, repo, tag, err := parseImageRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		script += fmt.Sprintf("crane copy %s localhost:5000/%s:%s --insecure\n", img, repo, tag)
+	}
+	return dag.Container().
+		From(registryImage).
+		WithFile("/bin/crane", crane()).
+		WithExec([]string{"sh", "-ec", script}).
+		Directory("/var/lib/registry"), nil
+}
+
+// returns the hostname of the image cache
+func (t *Talos) imageCacheHostname() string {
+	return fmt.Sprintf("%s-image-cache", t.Name)
+}
+
+// returns the services bound to every node
+func (t *Talos) bindings() []ServiceBinding {
+	var bindings []ServiceBinding
+	if len(t.Images) > 0 {
+		bindings = append(bindings, ServiceBinding{Hostname: t.registryHostname(), Service: t.registry()})
+	}
+	for i, m := range t.Mirrors {
+		if m.Service != nil {
+			bindings = append(bindings, ServiceBinding{Hostname: fmt.Sprintf("%s-mirror-%d", t.Name, i+1), Service: m.Service})
+		}
+	}
+	if t.Cache != nil {
+		bindings = append(bindings, ServiceBinding{Hostname: t.imageCacheHostname(), Service: dag.Container().
+			From(registryImage).
+			WithDirectory("/var/lib/registry", t.Cache.Dir).
+			WithExposedPort(5000).
+			AsService()})
+	}
+	return bindings
+}
+
+// returns the node service with the services bound to every node
+func (t *Talos) nodeService(n TalosNode, withExposedAPI bool) *dagger.Service {
+	return n.service(withExposedAPI, t.bindings())
+}
+
+// returns the machine.registries config, the loaded images first, then the mirrors, then the image cache
+func (t *Talos) registriesConfig(ctx context.Context) (map[string]any, error) {
+	mirrors := map[string][]string{}
+	add := func(host string, endpoints ...string) {
+		for _, e := range endpoints {
+			if !slices.Contains(mirrors[host], e) {
+				mirrors[host] = append(mirrors[host], e)
+			}
+		}
+	}
+	for _, img := range t.Images {
+		host, _, _, _ := parseImageRef(img.Ref)
+		add(host, fmt.Sprintf("http://%s:5000", t.registryHostname()))
+	}
+	config := map[string]any{}
+	for _, m := range t.Mirrors {
+		add(m.Host, m.Endpoints...)
+		c := map[string]any{}
+		if m.Password != nil {
+			password, err := m.Password.Plaintext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			c["auth"] = map[string]any{"username": m.Username, "password": password}
+		}
+		tls := map[string]any{}
+		if m.CA != nil {
+			ca, err := m.CA.Contents(ctx)
+			if err != nil {
+				return nil, err
+			}
+			tls["ca"] = base64.StdEncoding.EncodeToString([]byte(ca))
+		}
+		if m.InsecureSkipVerify {
+			tls["insecureSkipVerify"] = true
+		}
+		if len(tls) > 0 {
+			c["tls"] = tls
+		}
+		if len(c) == 0 {
+			continue
+		}
+		for _, e := range m.Endpoints {
+			u, err := url.Parse(e)
+			if err != nil {
+				return nil, err
+			}
+			config[u.Host] = c
+		}
+	}
+	if t.Cache != nil {
+		for _, host := range t.Cache.Hosts {
+			add(host, fmt.Sprintf("http://%s:5000", t.imageCacheHostname()))
+		}
+	}
+	if len(mirrors) == 0 {
+		return nil, nil
+	}
+	registries := map[string]any{}
+	m := map[string]any{}
+	for host, endpoints := range mirrors {
+		m[host] = map[string]any{"endpoints": endpoints}
+	}
+	registries["mirrors"] = m
+	if len(config) > 0 {
+		registries["config"] = config
+	}
+	return registries, nil
+}
+
+// mounts the registries patch, which may contain credentials, and returns the talosctl apply flags applying it
+func (t *Talos) withRegistries(ctx context.Context, ctr *dagger.Container) (*dagger.Container, []string, error) {
+	registries, err := t.registriesConfig(ctx)
+	if err != nil || registries == nil {
+		return ctr, nil, err
+	}
+	patch, err := json.Marshal(map[string]any{"machine": map[string]any{"registries": registries}})
+	if err != nil {
+		return nil, nil, err
+	}
+	secret := dag.SetSecret(fmt.Sprintf("%s-registries", t.Name), string(patch))
+	return ctr.WithMountedSecret("patches-registries.json", secret), []string{"--config-patch=@patches-registries.json"}, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"dagger/talos/internal/dagger"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// the Kubernetes minors supported by each Talos minor, the last one is the Talos default
+// https://www.talos.dev/latest/introduction/support-matrix/
+var kubernetesSupport = map[string][2]int{
+	"1.5":  {23, 28},
+	"1.6":  {24, 29},
+	"1.7":  {25, 30},
+	"1.8":  {26, 31},
+	"1.9":  {27, 32},
+	"1.10": {28, 33},
+	"1.11": {29, 34},
+}
+
+// returns the major and minor of a version like v1.8.3
+func majorMinor(version string) (int, int, error) {
+	var major, minor int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(version, "v"), "%d.%d", &major, &minor); err != nil {
+		return 0, 0, fmt.Errorf("invalid version %q: %w", version, err)
+	}
+	return major, minor, nil
+}
+
+// a full Kubernetes release, the image tags and kubectl downloads need the patch version
+var kubernetesVersionRegexp = regexp.MustCompile(`^v?\d+\.\d+\.\d+$`)
+
+// checks that the Kubernetes version is a full release the Talos release supports
+func validateKubernetesVersion(talosVersion string, kubernetesVersion string) error {
+	if !kubernetesVersionRegexp.MatchString(kubernetesVersion) {
+		return fmt.Errorf("invalid Kubernetes version %q, expected MAJOR.MINOR.PATCH (e.g. 1.31.2)", kubernetesVersion)
+	}
+	talosMajor, talosMinor, err := majorMinor(talosVersion)
+	if err != nil {
+		return err
+	}
+	major, minor, err := majorMinor(kubernetesVersion)
+	if err != nil {
+		return err
+	}
+	supported, ok := kubernetesSupport[fmt.Sprintf("%d.%d", talosMajor, talosMinor)]
+	if !ok {
+		// unknown releases are left to talosctl
+		return nil
+	}
+	if major != 1 || minor < supported[0] || minor > supported[1] {
+		return fmt.Errorf("talos %s supports Kubernetes 1.%d to 1.%d, not %s", talosVersion, supported[0], supported[1], kubernetesVersion)
+	}
+	return nil
+}
+
+// the kubectl release used for each Kubernetes minor when the cluster runs the Talos default version
+var kubectlVersions = map[int]string{
+	23: "1.23.17",
+	24: "1.24.17",
+	25: "1.25.16",
+	26: "1.26.15",
+	27: "1.27.16",
+	28: "1.28.15",
+	29: "1.29.10",
+	30: "1.30.6",
+	31: "1.31.2",
+	32: "1.32.0",
+	33: "1.33.0",
+	34: "1.34.0",
+}
+
+// returns the kubectl release matching the Kubernetes version of the cluster, e.g. 1.31.2
+func (t *Talos) kubectlVersion() string {
+	if t.KubernetesVersion != "" {
+		return t.KubernetesVersion
+	}
+	if major, minor, err := majorMinor(t.Version); err == nil {
+		if supported, ok := kubernetesSupport[fmt.Sprintf("%d.%d", major, minor)]; ok {
+			return kubectlVersions[supported[1]]
+		}
+	}
+	return kubectlVersions[slices.Max(slices.Collect(maps.Keys(kubectlVersions)))]
+}
+
+// returns a kubectl binary matching the Kubernetes version of the cluster
+func (t *Talos) kubectl() *dagger.File {
+	return dag.Container().
+		From("alpine:3.20").
+		WithExec([]string{"sh", "-ec", fmt.Sprintf("arch=$(uname -m | sed 's/x86_64/amd64/;s/aarch64/arm64/')\n"+
+			"wget -q -O /kubectl https://dl.k8s.io/release/v%s/bin/linux/$arch/kubectl\n"+
+			"chmod +x /kubectl", t.kubectlVersion())}).
+		File("/kubectl")
+}
+
+// returns the command waiting for the resources to be created, kubectl wait --for=create needs kubectl 1.31
+func waitForCreate(timeout string, resources ...string) []string {
+	return []string{"wait4x", "exec", "kubectl get " + strings.Join(resources, " "), "--timeout", timeout}
+}